@@ -0,0 +1,105 @@
+// Package aict tunnels packets in icmp echoes, for embedding in other programs.
+// Dial and Listen return a PacketConn per peer, which is a net.PacketConn.
+// Sessions multiplex reliable streams over it, each stream is a net.Conn.
+package aict
+
+import (
+	"fmt"
+	"github.com/BaiMeow/aict/client"
+	"github.com/BaiMeow/aict/server"
+	"net"
+)
+
+// Conn sends packets to and receives packets from a peer,
+// packets up to 64KB are fragmented to fit in echoes.
+type Conn interface {
+	ReadPacket() ([]byte, error)
+	WritePacket(data []byte) error
+	// ReadPacketTo and WritePacketFrom don't keep buf, so it can be reused
+	ReadPacketTo(buf []byte) (int, error)
+	WritePacketFrom(data []byte) error
+	// WritePackets is WritePacketFrom for a batch
+	WritePackets(packets [][]byte) error
+}
+
+// ClientConfig and ServerConfig are the options of Dial and Listen
+type (
+	ClientConfig = client.Config
+	ServerConfig = server.Config
+)
+
+// Dial connects to the server at address, an ip or a host name.
+// ICMPv6 is used for an ipv6 address. cfg may be nil.
+func Dial(address string, cfg *ClientConfig) (*PacketConn, error) {
+	raddr, err := net.ResolveIPAddr("ip", address)
+	if err != nil {
+		return nil, fmt.Errorf("aict: resolve: %v", err)
+	}
+	laddr := &net.IPAddr{IP: net.IPv4zero}
+	if raddr.IP.To4() == nil {
+		laddr.IP = net.IPv6unspecified
+	}
+	c := ClientConfig{}
+	if cfg != nil {
+		c = *cfg
+	}
+	conn, err := client.Dial(laddr, raddr, &c)
+	if err != nil {
+		return nil, err
+	}
+	return &PacketConn{peerConn: conn}, nil
+}
+
+// Listener accepts clients, each one as a PacketConn
+type Listener struct {
+	l *server.Listener
+}
+
+// Listen accepts clients from any address on the local address,
+// ICMPv6 is used for an ipv6 address. cfg may be nil.
+func Listen(address string, cfg *ServerConfig) (*Listener, error) {
+	laddr, err := net.ResolveIPAddr("ip", address)
+	if err != nil {
+		return nil, fmt.Errorf("aict: resolve: %v", err)
+	}
+	raddr := &net.IPAddr{IP: net.IPv4zero}
+	if laddr.IP.To4() == nil {
+		raddr.IP = net.IPv6unspecified
+	}
+	c := ServerConfig{}
+	if cfg != nil {
+		c = *cfg
+	}
+	l, err := server.Listen(laddr, raddr, &c)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{l: l}, nil
+}
+
+// Accept waits for a new client
+func (l *Listener) Accept() (*PacketConn, error) {
+	c, err := l.l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &PacketConn{peerConn: c}, nil
+}
+
+// AcceptSession waits for a new client and starts a Session with it
+func (l *Listener) AcceptSession() (*Session, error) {
+	c, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewSession(c, false), nil
+}
+
+// Close closes the socket and all clients
+func (l *Listener) Close() error {
+	return l.l.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.l.Addr()
+}
@@ -0,0 +1,107 @@
+package aict
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	l, err := ListenStream("127.0.0.1", &ServerConfig{IdleTimeout: -1})
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	defer l.Close()
+	s, err := DialSession("127.0.0.1", &ClientConfig{PingInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// echo server
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = io.Copy(c, c)
+	}()
+
+	c, err := s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("aict stream "), 10000)
+	go func() {
+		_, _ = c.Write(data)
+	}()
+	if err := c.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echoed data mismatch")
+	}
+
+	_ = s.Close()
+	if c, err := s.Open(); err == nil || c != nil {
+		t.Fatalf("open on closed session: %v, %v", c, err)
+	}
+	if c, err := s.Accept(); err == nil || c != nil {
+		t.Fatalf("accept on closed session: %v, %v", c, err)
+	}
+}
+
+func TestPacketConnDeadline(t *testing.T) {
+	l, err := Listen("127.0.0.1", nil)
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	defer l.Close()
+	c, err := Dial("127.0.0.1", &ClientConfig{PingInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.WriteTo([]byte("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	if err := sc.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, addr, err := sc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" || addr.String() != "127.0.0.1" {
+		t.Fatalf("read %q from %v", buf[:n], addr)
+	}
+
+	// truncated like udp
+	if _, err := c.WriteTo([]byte("hello again"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := sc.ReadFrom(buf[:5]); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+
+	if err := sc.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sc.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package aict
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// peerConn is client.AictConn or server.AictConn
+type peerConn interface {
+	Conn
+	io.Closer
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	Logger() *slog.Logger
+}
+
+// PacketConn is a Conn to a single peer, and a net.PacketConn
+// whose packets are read from and written to the peer.
+type PacketConn struct {
+	peerConn
+}
+
+var _ net.PacketConn = (*PacketConn)(nil)
+
+// ReadFrom reads a packet from the peer, like UDP a packet longer
+// than p is truncated to len(p) without error
+func (c *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	data, err := c.ReadPacket()
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(p, data), c.RemoteAddr(), nil
+}
+
+// WriteTo writes p to the peer whatever addr is
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if err := c.WritePacketFrom(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
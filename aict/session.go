@@ -0,0 +1,151 @@
+package aict
+
+import (
+	"errors"
+	"github.com/BaiMeow/aict/mux"
+	"github.com/BaiMeow/aict/stream"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// ErrClosed is returned by Accept of a closed StreamListener
+var ErrClosed = errors.New("aict: listener closed")
+
+// Session multiplexes reliable streams over a PacketConn, each stream is a net.Conn.
+// It is a net.Listener of the streams opened by the peer.
+type Session struct {
+	s    *mux.Session
+	addr net.Addr
+}
+
+var _ net.Listener = (*Session)(nil)
+
+// NewSession starts a session over c, which is closed with the session.
+// client is true on the side of Dial, the two sides must differ.
+// The session and its streams log to the Logger of the config of c.
+func NewSession(c *PacketConn, client bool) *Session {
+	return &Session{s: mux.New(c, client, &stream.Config{Logger: c.Logger()}), addr: c.LocalAddr()}
+}
+
+// DialSession dials the server and starts a Session with it
+func DialSession(address string, cfg *ClientConfig) (*Session, error) {
+	c, err := Dial(address, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewSession(c, true), nil
+}
+
+// Open opens a stream, the peer gets it from Accept once data arrives
+func (s *Session) Open() (net.Conn, error) {
+	c, err := s.s.Open()
+	if err != nil {
+		// a nil *stream.Conn is not a nil net.Conn
+		return nil, err
+	}
+	return c, nil
+}
+
+// Accept waits for a stream opened by the peer
+func (s *Session) Accept() (net.Conn, error) {
+	c, err := s.s.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes all streams and the PacketConn
+func (s *Session) Close() error {
+	return s.s.Close()
+}
+
+func (s *Session) Addr() net.Addr {
+	return s.addr
+}
+
+// StreamListener accepts streams opened by all clients, it is a net.Listener.
+type StreamListener struct {
+	l      *Listener
+	accept chan net.Conn
+	log    *slog.Logger
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ net.Listener = (*StreamListener)(nil)
+
+// ListenStream is Listen with a Session of every client, see Listen
+func ListenStream(address string, cfg *ServerConfig) (*StreamListener, error) {
+	l, err := Listen(address, cfg)
+	if err != nil {
+		return nil, err
+	}
+	sl := &StreamListener{
+		l:      l,
+		accept: make(chan net.Conn),
+		log:    l.l.Logger(),
+		done:   make(chan struct{}),
+	}
+	go sl.acceptRoutine()
+	return sl, nil
+}
+
+func (l *StreamListener) acceptRoutine() {
+	for {
+		s, err := l.l.AcceptSession()
+		if err != nil {
+			select {
+			case <-l.done:
+			default:
+				l.log.Error("accept session", "err", err)
+				_ = l.Close()
+			}
+			return
+		}
+		go l.serve(s)
+	}
+}
+
+// serve queues the streams of s until it ends
+func (l *StreamListener) serve(s *Session) {
+	for {
+		c, err := s.Accept()
+		if err != nil {
+			_ = s.Close()
+			return
+		}
+		select {
+		case <-l.done:
+			_ = c.Close()
+			_ = s.Close()
+			return
+		case l.accept <- c:
+		}
+	}
+}
+
+func (l *StreamListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, ErrClosed
+	case c := <-l.accept:
+		return c, nil
+	}
+}
+
+// Close closes the listener and all clients
+func (l *StreamListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.l.Close()
+	})
+	return err
+}
+
+func (l *StreamListener) Addr() net.Addr {
+	return l.l.Addr()
+}
@@ -4,93 +4,232 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/BaiMeow/aict/ds"
+	"github.com/BaiMeow/aict/metrics"
 	"github.com/BaiMeow/aict/proto"
-	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
-	"golang.org/x/time/rate"
-	"log"
+	"io"
+	"log/slog"
 	"math"
 	"net"
+	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 const (
-	bufferSize     = 1700
-	bufferQueueLen = 1024
-	boostPeriod    = 500 * time.Millisecond
-	RTT            = 10 * time.Millisecond
+	bufferSize        = 65535
+	bufferQueueLen    = 1024
+	reassembleTimeout = 5 * time.Second
+	boostPeriod       = 500 * time.Millisecond
+	// RTT is the initial interval between echo requests of AIMDPacer
+	RTT = 10 * time.Millisecond
 )
 
+// packet is a layer queued for writeRoutine, buf is recycled once sent
+type packet struct {
+	layer proto.Layer
+	buf   *ds.Buffer
+}
+
 type AictConn struct {
-	conn         net.PacketConn
+	// sock is replaced on redial
+	sock         atomic.Pointer[socket]
+	unprivileged bool
+	laddr        *net.IPAddr
 	raddr        *net.IPAddr
-	identify     int
-	readBuffer   chan []byte
-	writeBuffer  chan []byte
+	// dst is raddr in the address type of conn
+	dst          net.Addr
+	family       *proto.Family
+	psh          []byte
+	readBuffer   chan *ds.Buffer
+	writeBuffer  chan packet
 	sequence     atomic.Uint32
 	peerSequence atomic.Uint32
 	readCounter  atomic.Uint32
 	cancel       context.CancelFunc
 	ctx          context.Context
+	// err is why the conn is closed
+	err       error
+	closeOnce sync.Once
+	// lastReply is the unix nano of the last echo reply
+	lastReply atomic.Int64
+	reconnect bool
+	// session is the Handshake.Session, a new one is chosen on redial
+	session     atomic.Uint32
+	handshakeOK chan proto.Handshake
+	// version and caps are negotiated by handshake
+	version    atomic.Uint32
+	caps       atomic.Uint32
+	redialLock sync.Mutex
 
-	peerQueueSize    int
+	peerQueueSize int
+	// peerCredit is the latest proto.Credit from server, nil if the server sends none
+	peerCredit       atomic.Pointer[proto.Credit]
 	sentSequenceN    int
 	minSentSequenceN int
 	maxSentSequenceN int
 
-	sendLimiter *rate.Limiter
+	pacer  Pacer
+	flight flight
+
+	// maxPayload is the max layer payload in one echo, larger packets are fragmented
+	maxPayload  atomic.Int32
+	echoSize    int
+	fragmentID  atomic.Uint32
+	reassembler *proto.Reassembler
+	pmtu        pathMTU
+	// pmtuDiscovery starts after the first handshake,
+	// since the server ignores probes before a session starts
+	pmtuDiscovery bool
+
+	// compression is offered in handshake, packets are deflated if negotiated
+	compression bool
+
+	// cipher is nil if encryption is disabled
+	cipher *proto.Cipher
+	nonce  *proto.NonceSource
+	replay proto.ReplayWindow
+
+	stats   stats
+	metrics metrics.Metrics
+	// peerDepth is the Credit.Depth of the last reply, airSeqCount is sentSequenceN
+	peerDepth   atomic.Int32
+	airSeqCount atomic.Int32
 
 	sequenceTimer *time.Timer
+
+	log *slog.Logger
+
+	// keepalivePayload, if set, provides data carried by keepalives
+	keepalivePayload atomic.Pointer[func() []byte]
+
+	readDeadline  *ds.Deadline
+	writeDeadline *ds.Deadline
 }
 
-func newAict(conn net.PacketConn, raddr *net.IPAddr, cfg *Config) *AictConn {
+func newAict(conn net.PacketConn, laddr, raddr *net.IPAddr, cfg *Config) *AictConn {
 	ctx, cancel := context.WithCancel(context.Background())
+	family := proto.FamilyOf(raddr.IP)
+	var (
+		dst net.Addr = raddr
+		psh          = family.PseudoHeader(laddr.IP, raddr.IP)
+	)
+	if cfg.Unprivileged {
+		// the kernel fills the checksum of datagram sockets
+		dst = &net.UDPAddr{IP: raddr.IP, Zone: raddr.Zone}
+		psh = nil
+	}
 	c := &AictConn{
-		conn:             conn,
+		unprivileged:     cfg.Unprivileged,
+		reconnect:        cfg.Reconnect,
+		handshakeOK:      make(chan proto.Handshake, 1),
+		laddr:            laddr,
 		raddr:            raddr,
-		identify:         cfg.Identify,
+		dst:              dst,
+		family:           family,
+		psh:              psh,
 		cancel:           cancel,
-		readBuffer:       make(chan []byte, bufferQueueLen),
-		writeBuffer:      make(chan []byte, bufferQueueLen),
+		readBuffer:       make(chan *ds.Buffer, bufferQueueLen),
+		writeBuffer:      make(chan packet, bufferQueueLen),
 		ctx:              ctx,
-		sentSequenceN:    cfg.minAirSeqCount,
-		minSentSequenceN: cfg.minAirSeqCount,
-		maxSentSequenceN: cfg.maxAirSeqCount,
-		sequenceTimer:    time.NewTimer(boostPeriod / time.Duration(cfg.minAirSeqCount)),
-		sendLimiter:      rate.NewLimiter(rate.Every(RTT), 1),
+		sentSequenceN:    cfg.MinAirSeqCount,
+		minSentSequenceN: cfg.MinAirSeqCount,
+		maxSentSequenceN: cfg.MaxAirSeqCount,
+		sequenceTimer:    time.NewTimer(boostPeriod / time.Duration(cfg.MinAirSeqCount)),
+		pacer:            cfg.Pacer,
+		echoSize:         cfg.EchoSize,
+		pmtuDiscovery:    cfg.PathMTUDiscovery,
+		reassembler:      proto.NewReassembler(reassembleTimeout),
+		cipher:           cfg.cipher,
+		compression:      cfg.Compression,
+		nonce:            proto.NewNonceSource(),
+		pmtu: pathMTU{
+			waiting: make(map[uint16]chan time.Duration),
+			done:    make(chan struct{}),
+		},
+		readDeadline:  ds.NewDeadline(),
+		writeDeadline: ds.NewDeadline(),
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
 	}
+	c.log = logger.With("peer", raddr.String())
+	c.sock.Store(&socket{conn: proto.NewBatchConn(conn), identify: cfg.Identify})
+	c.lastReply.Store(time.Now().UnixNano())
+	c.airSeqCount.Store(int32(c.sentSequenceN))
+	if c.pacer == nil {
+		c.pacer = NewAIMDPacer()
+	}
+	c.setEchoSize(cfg.EchoSize)
 	go func() {
 		err := c.readRoutine()
 		if err == nil {
 			return
 		}
-		log.Printf("read routine: %v", err)
+		c.log.Error("read routine", "err", err)
 		err = c.Close()
 		if err == nil {
 			return
 		}
-		log.Printf("close: %v", err)
+		c.log.Warn("close", "err", err)
 	}()
 	go func() {
 		err := c.writeRoutine()
 		if err == nil {
 			return
 		}
-		log.Printf("write routine: %v", err)
+		c.log.Error("write routine", "err", err)
 		err = c.Close()
 		if err == nil {
 			return
 		}
-		log.Printf("close: %v", err)
+		c.log.Warn("close", "err", err)
 	}()
 	go c.booster()
+	if cfg.PingInterval >= 0 {
+		interval := cfg.PingInterval
+		if interval == 0 {
+			interval = defaultPingInterval
+		}
+		go c.pinger(interval)
+		// replies of pings tell if the peer is alive
+		if cfg.DeadTimeout >= 0 {
+			timeout := cfg.DeadTimeout
+			if timeout == 0 {
+				timeout = defaultDeadTimeout
+			}
+			go c.watchdog(timeout)
+		}
+	}
+	if !cfg.PathMTUDiscovery {
+		close(c.pmtu.done)
+	}
+	c.startHandshake()
 	return c
 }
 
+// Close tells the server to end the session and closes the conn
 func (c *AictConn) Close() error {
-	c.cancel()
-	return c.conn.Close()
+	select {
+	case <-c.ctx.Done():
+	default:
+		// best effort, the server ends idle sessions anyway
+		_ = c.writeEcho(c.sock.Load(), make([]byte, 64), &proto.Layer{Flags: proto.FlagClose})
+	}
+	return c.closeWithError(ErrClosed)
+}
+
+// closeWithError closes the conn, later reads and writes return err
+func (c *AictConn) closeWithError(err error) error {
+	var closeErr error
+	c.closeOnce.Do(func() {
+		c.err = err
+		c.cancel()
+		closeErr = c.sock.Load().conn.Close()
+	})
+	return closeErr
 }
 
 func (c *AictConn) booster() {
@@ -102,13 +241,19 @@ func (c *AictConn) booster() {
 			return
 		case <-tBoost.C:
 			count := c.readCounter.Swap(0)
-			//cost := max(uint32(c.sentSequenceN)-(c.sequence.Load()-c.peerSequence.Load()), 1)
-			// ensure fold [0,1]
-			//calc := float64(cost) / 0.6
-			calc := float64(count)/0.6*0.5 + float64(c.sentSequenceN)*0.5
+			var calc float64
+			if credit := c.peerCredit.Swap(nil); credit != nil {
+				// refill what the server consumed and what waits,
+				// keep a reserve of minSentSequenceN pairs in its queue
+				calc = float64(count) + float64(credit.Waiting) + float64(c.minSentSequenceN) - float64(credit.Depth)
+			} else {
+				// no feedback, guess from the replies
+				calc = float64(count)/0.6*0.5 + float64(c.sentSequenceN)*0.5
+			}
 			calc = min(max(calc, float64(c.minSentSequenceN)), float64(c.maxSentSequenceN))
-			log.Printf("icmp: air seq count %d", int(calc))
+			c.log.Debug("boost", "airSeqCount", int(calc))
 			c.sentSequenceN = int(calc)
+			c.airSeqCount.Store(int32(calc))
 			c.sequenceTimer.Stop()
 			// notify write routine to reset timer
 			c.sequenceTimer.Reset(1)
@@ -122,6 +267,20 @@ func (c *AictConn) cancelSeqOnce() {
 }
 
 func (c *AictConn) readRoutine() error {
+	// packets are decoded in place and copied out, so bufs are reused
+	bufs := make([][]byte, proto.BatchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, bufferSize)
+	}
+	ms := make([]proto.Message, proto.BatchSize)
+	// zbuf holds decompressed packets
+	zbuf := make([]byte, bufferSize)
+	var msg proto.Layer
+	// dropped is the Credit.Dropped of the last reply
+	var (
+		dropped     uint16
+		haveDropped bool
+	)
 	for {
 		select {
 		case <-c.ctx.Done():
@@ -129,137 +288,416 @@ func (c *AictConn) readRoutine() error {
 		default:
 		}
 
-		buf := make([]byte, bufferSize)
-		err := c.conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+		sock := c.sock.Load()
+		err := sock.conn.SetReadDeadline(time.Now().Add(time.Second * 30))
 		if err != nil {
+			if c.sock.Load() != sock {
+				// closed by redial
+				continue
+			}
 			// exit
 			if err := c.Close(); err != nil {
-				log.Printf("close: %v", err)
+				c.log.Warn("close", "err", err)
 			}
 			return fmt.Errorf("set read readline: %v", err)
 		}
-		n, addr, err := c.conn.ReadFrom(buf)
+		for i := range ms {
+			ms[i].Buf = bufs[i]
+		}
+		n, err := sock.conn.ReadBatch(ms)
 		if err != nil {
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Timeout() {
 				continue
 			}
+			if c.sock.Load() != sock {
+				continue
+			}
+			select {
+			case <-c.ctx.Done():
+				// closed
+				return nil
+			default:
+			}
 			// exit
 			if err := c.Close(); err != nil {
-				log.Printf("close: %v", err)
+				c.log.Warn("close", "err", err)
 			}
 			return fmt.Errorf("read packet: %v", err)
 		}
 
-		ipAddr, ok := addr.(*net.IPAddr)
-		if !ok {
-			return fmt.Errorf("under conn addr type not ip addr")
-		}
-		if !ipAddr.IP.Equal(c.raddr.IP) {
-			continue
-		}
+		for i := 0; i < n; i++ {
+			ip := proto.AddrIP(ms[i].Addr)
+			if ip == nil {
+				return fmt.Errorf("under conn addr type not ip addr")
+			}
+			if !ip.Equal(c.raddr.IP) {
+				continue
+			}
 
-		m, err := icmp.ParseMessage(1, buf[:n])
-		if err != nil {
-			log.Printf("aict: parse: %v", err)
-			continue
-		}
-		echo, ok := m.Body.(*icmp.Echo)
-		if !ok || m.Type != ipv4.ICMPTypeEchoReply {
-			continue
-		}
+			echo, err := proto.ParseEcho(ms[i].Buf)
+			if err != nil {
+				// other icmp traffic of the host
+				c.metrics.ParseErrors.Add(1)
+				c.log.Debug("parse echo", "err", err)
+				continue
+			}
+			if echo.Type != c.family.EchoReplyType || (echo.ID != uint16(sock.identify) && !c.unprivileged) {
+				continue
+			}
 
-		seq := uint16(uint32(echo.Seq) & 0xffff)
+			nonce, err := proto.Decode(&msg, &echo, c.cipher)
+			if err == nil && c.cipher != nil && !c.replay.Check(nonce) {
+				err = proto.ErrReplay
+			}
+			if err != nil {
+				c.metrics.ParseErrors.Add(1)
+				c.log.Warn("decode echo reply", "id", echo.ID, "seq", echo.Seq, "err", err)
+				// skip
+				continue
+			}
+			c.lastReply.Store(time.Now().UnixNano())
+			c.metrics.Received(len(echo.Data), msg.Flags&proto.FlagKeepalive > 0)
+			if c.log.Enabled(c.ctx, slog.LevelDebug) {
+				c.log.Debug("echo reply", "id", echo.ID, "seq", echo.Seq, "flags", msg.Flags, "len", len(echo.Data))
+			}
 
-		c.readCounter.Add(1)
-	UpdatePeerSeq:
-		old := c.peerSequence.Load()
-		if seq-uint16(old) < math.MaxUint16/2 {
-			if !c.peerSequence.CompareAndSwap(old, uint32(seq)) {
-				goto UpdatePeerSeq
+			seq := echo.Seq
+			rtt, skipped := c.flight.reply(seq)
+			if rtt > 0 {
+				c.pacer.OnReply(rtt)
 			}
-		}
 
-		msg := &proto.Layer{}
-		if err := msg.Unmarshal(echo.Data); err != nil {
-			fmt.Println("unmarshal error: ", err)
-			// skip
-			continue
-		}
+			switch {
+			case msg.Flags&proto.FlagPing > 0:
+				// replied right away, not taken from the peer's queue
+				c.pong(&msg, rtt)
+				continue
+			case msg.Flags&proto.FlagHandshake > 0:
+				c.handshakeReply(&msg)
+				continue
+			case msg.Flags&proto.FlagClose > 0:
+				c.peerClosed(msg.Payload)
+				continue
+			}
 
-		if msg.Flags&proto.FlagKeepalive > 0 {
-			continue
+			c.readCounter.Add(1)
+		UpdatePeerSeq:
+			old := c.peerSequence.Load()
+			if seq-uint16(old) < math.MaxUint16/2 {
+				if !c.peerSequence.CompareAndSwap(old, uint32(seq)) {
+					goto UpdatePeerSeq
+				}
+			}
+
+			if msg.Flags&proto.FlagKeepalive > 0 {
+				continue
+			}
+			payload := msg.Payload
+			if msg.Flags&proto.FlagCredit > 0 {
+				var credit proto.Credit
+				payload, err = credit.Cut(payload)
+				if err != nil {
+					c.log.Warn("credit", "seq", seq, "err", err)
+					continue
+				}
+				c.peerCredit.Store(&credit)
+				c.peerDepth.Store(int32(credit.Depth))
+				// skipped pairs not discarded by server are lost on the way
+				if haveDropped {
+					if lost := skipped - int(credit.Dropped-dropped); lost > 0 {
+						c.pacer.OnLoss(lost)
+					}
+				}
+				dropped, haveDropped = credit.Dropped, true
+			}
+			fragment := msg.Flags&proto.FlagFragment > 0
+			if fragment {
+				payload, err = c.reassembler.Add(payload)
+				if err != nil {
+					c.log.Warn("reassemble", "seq", seq, "err", err)
+					continue
+				}
+				if payload == nil {
+					continue
+				}
+			}
+			var b *ds.Buffer
+			if msg.Flags&proto.FlagCompress > 0 {
+				payload, err = proto.Decompress(zbuf, payload)
+				if err != nil {
+					c.log.Warn("decompress", "seq", seq, "err", err)
+					continue
+				}
+				b = proto.CopyPacket(payload)
+			} else if fragment {
+				// a new slice, not in buf
+				b = &ds.Buffer{B: payload}
+			} else {
+				b = proto.CopyPacket(payload)
+			}
+
+			select {
+			case <-c.ctx.Done():
+				proto.PacketPool.Put(b)
+				return nil
+			case c.readBuffer <- b:
+			default:
+				// reader is too slow, don't block keepalive and pings
+				c.metrics.Drops.Add(1)
+				proto.PacketPool.Put(b)
+			}
 		}
-		c.readBuffer <- msg.Payload
 	}
 }
 
 func (c *AictConn) writeRoutine() error {
+	// echoes are encoded in place into wbufs and sent in batches
+	wbufs := make([][]byte, proto.BatchSize)
+	for i := range wbufs {
+		wbufs[i] = make([]byte, bufferSize)
+	}
+	ms := make([]proto.Message, proto.BatchSize)
 	for {
-		aictLayer := proto.Layer{
-			Flags: 0,
-		}
+		var p packet
+		aictLayer := &p.layer
 		select {
 		case <-c.ctx.Done():
 			c.sequenceTimer.Stop()
 			return nil
-		case aictLayer.Payload = <-c.writeBuffer:
+		case p = <-c.writeBuffer:
 			c.cancelSeqOnce()
 		case <-c.sequenceTimer.C:
 			c.sequenceTimer.Reset(boostPeriod / time.Duration(c.sentSequenceN))
 			aictLayer.Flags = proto.FlagKeepalive
+			if f := c.keepalivePayload.Load(); f != nil {
+				if p := (*f)(); p != nil {
+					aictLayer.Flags = 0
+					aictLayer.Payload = p
+				}
+			}
 		}
 
-		// rate limit
-		err := c.sendLimiter.Wait(c.ctx)
+		err := c.pacer.Wait(c.ctx)
 		if err != nil {
-			return fmt.Errorf("rate limit: %v", err)
+			proto.PacketPool.Put(p.buf)
+			if c.ctx.Err() != nil {
+				// closed while waiting
+				return nil
+			}
+			return fmt.Errorf("pace: %v", err)
 		}
 
-		data, err := aictLayer.Marshal()
-		if err != nil {
-			log.Printf("marshal aict layer: %v", err)
-			continue
-		}
-		msg := icmp.Message{
-			Type: ipv4.ICMPTypeEcho,
-			Code: 0,
-			Body: &icmp.Echo{
-				ID:   c.identify,
-				Seq:  int(uint16(c.sequence.Add(1))),
-				Data: data,
-			},
-		}
-		raw, err := msg.Marshal(nil)
-		if err != nil {
-			log.Printf("marshal icmp message: %v", err)
+		sock := c.sock.Load()
+		n := 0
+		for {
+			if raw := c.echoTo(sock, wbufs[n], aictLayer); raw != nil {
+				ms[n] = proto.Message{Buf: raw, Addr: c.dst}
+				n++
+			}
+			proto.PacketPool.Put(p.buf)
+			// only the write routine receives, so a queued packet is there
+			if n == len(ms) || len(c.writeBuffer) == 0 || !c.allow() {
+				break
+			}
+			p = <-c.writeBuffer
+			aictLayer = &p.layer
 		}
-		_, err = c.conn.WriteTo(raw, c.raddr)
-		if err != nil {
+		if err := sock.conn.WriteBatch(ms[:n]); err != nil {
+			if c.sock.Load() != sock {
+				// closed by redial
+				continue
+			}
 			return fmt.Errorf("write to conn: %v", err)
 		}
 	}
 }
 
+// allow tells if the pacer lets an echo request go right now, for batching
+func (c *AictConn) allow() bool {
+	p, ok := c.pacer.(BatchPacer)
+	return ok && p.Allow()
+}
+
+// writeEcho encodes the layer in an echo request into b and sends it on sock,
+// a layer failing to encode is dropped.
+func (c *AictConn) writeEcho(sock *socket, b []byte, l *proto.Layer) error {
+	raw := c.echoTo(sock, b, l)
+	if raw == nil {
+		return nil
+	}
+	if _, err := sock.conn.WriteTo(raw, c.dst); err != nil {
+		return fmt.Errorf("write to conn: %v", err)
+	}
+	return nil
+}
+
+// echoTo encodes the layer in an echo request of sock into b and returns it,
+// nil if the layer fails to encode.
+func (c *AictConn) echoTo(sock *socket, b []byte, l *proto.Layer) []byte {
+	n, err := proto.EncodeTo(b[proto.EchoHeaderLen:], l, c.cipher, c.nonce, c.family.EchoRequestType, uint16(sock.identify))
+	if err != nil {
+		c.log.Error("encode layer", "flags", l.Flags, "err", err)
+		return nil
+	}
+	seq := uint16(c.sequence.Add(1))
+	// the server replies pings and handshakes right away instead of queueing them
+	c.flight.sent(seq, l.Flags&(proto.FlagPing|proto.FlagHandshake) > 0)
+	raw := b[:proto.EchoHeaderLen+n]
+	c.family.PutEcho(raw, c.family.EchoRequestType, uint16(sock.identify), seq, c.psh)
+	c.metrics.Sent(n, l.Flags&proto.FlagKeepalive > 0)
+	if c.log.Enabled(c.ctx, slog.LevelDebug) {
+		c.log.Debug("echo request", "id", sock.identify, "seq", seq, "flags", l.Flags, "len", n)
+	}
+	return raw
+}
+
+// SetKeepalivePayload lets keepalives carry the data returned by f,
+// nil means nothing to carry and an empty keepalive is sent.
+func (c *AictConn) SetKeepalivePayload(f func() []byte) {
+	c.keepalivePayload.Store(&f)
+}
+
+// WritePacket sends data up to 64KB, packets larger than
+// Config.EchoSize are fragmented
 func (c *AictConn) WritePacket(data []byte) error {
+	if b := c.compress(data); b != nil {
+		return c.writePacket(proto.FlagCompress, b.B, b)
+	}
+	return c.writePacket(0, data, nil)
+}
 
-	select {
-	case <-c.ctx.Done():
-		return errors.New("connection closed")
-	default:
+// WritePacketFrom is WritePacket with a copy of data, so the caller may reuse
+// data right away. Packets fitting in one echo are copied without allocation.
+func (c *AictConn) WritePacketFrom(data []byte) error {
+	if b := c.compress(data); b != nil {
+		return c.writePacket(proto.FlagCompress, b.B, b)
+	}
+	if len(data) > c.PathMTU() || len(data) > proto.PacketPool.Size() {
+		return c.writePacket(0, append([]byte(nil), data...), nil)
+	}
+	b := proto.CopyPacket(data)
+	return c.writePacket(0, b.B, b)
+}
+
+// writePacket queues data with flags, fragmented if it doesn't fit in one echo.
+// b holding data is recycled once sent, unless fragments of it are queued.
+func (c *AictConn) writePacket(flags uint8, data []byte, b *ds.Buffer) error {
+	if len(data) <= c.PathMTU() {
+		select {
+		case <-c.ctx.Done():
+			proto.PacketPool.Put(b)
+			return c.err
+		case <-c.writeDeadline.Done():
+			proto.PacketPool.Put(b)
+			return os.ErrDeadlineExceeded
+		case c.writeBuffer <- packet{layer: proto.Layer{Flags: flags, Payload: data}, buf: b}:
+			return nil
+		}
+	}
+	layers, err := proto.Split(uint16(c.fragmentID.Add(1)), data, c.PathMTU())
+	if err != nil {
+		return err
+	}
+	for _, l := range layers {
+		l.Flags |= flags
+		select {
+		case <-c.ctx.Done():
+			return c.err
+		case <-c.writeDeadline.Done():
+			return os.ErrDeadlineExceeded
+		case c.writeBuffer <- packet{layer: l}:
+		}
+	}
+	return nil
+}
+
+// compress deflates data into a new buffer if compression is negotiated,
+// nil if it is not or data doesn't shrink
+func (c *AictConn) compress(data []byte) *ds.Buffer {
+	if uint8(c.caps.Load())&proto.CapCompression == 0 {
+		return nil
+	}
+	return proto.CompressPacket(data)
+}
+
+// WritePackets is WritePacketFrom for each packet, so the caller may reuse them.
+// Packets queued together are sent in batches.
+func (c *AictConn) WritePackets(packets [][]byte) error {
+	for _, data := range packets {
+		if err := c.WritePacketFrom(data); err != nil {
+			return err
+		}
 	}
-	c.writeBuffer <- data
 	return nil
 }
 
 func (c *AictConn) ReadPacket() ([]byte, error) {
+	b, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	// the caller owns it, not recycled
+	return b.B, nil
+}
+
+// ReadPacketTo is ReadPacket into buf without allocation, it returns
+// io.ErrShortBuffer and drops the packet if buf is too small.
+func (c *AictConn) ReadPacketTo(buf []byte) (int, error) {
+	b, err := c.readPacket()
+	if err != nil {
+		return 0, err
+	}
+	defer proto.PacketPool.Put(b)
+	if len(buf) < len(b.B) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(buf, b.B), nil
+}
+
+func (c *AictConn) readPacket() (*ds.Buffer, error) {
 	select {
 	case <-c.ctx.Done():
-		return nil, errors.New("connection closed")
-	case buf := <-c.readBuffer:
-		if buf == nil {
-			return nil, errors.New("connection closed")
+		return nil, c.err
+	case <-c.readDeadline.Done():
+		return nil, os.ErrDeadlineExceeded
+	case b := <-c.readBuffer:
+		if b == nil {
+			return nil, ErrClosed
 		}
-		return buf, nil
+		return b, nil
 	}
 }
+
+func (c *AictConn) LocalAddr() net.Addr {
+	return c.sock.Load().conn.LocalAddr()
+}
+
+func (c *AictConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// Logger is Config.Logger with the peer attached
+func (c *AictConn) Logger() *slog.Logger {
+	return c.log
+}
+
+// SetDeadline sets the read and write deadlines, see net.Conn
+func (c *AictConn) SetDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	c.writeDeadline.Set(t)
+	return nil
+}
+
+// SetReadDeadline makes reads return os.ErrDeadlineExceeded after t
+func (c *AictConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline makes writes blocked on a full queue return
+// os.ErrDeadlineExceeded after t, packets of a fragmented write may be sent partly
+func (c *AictConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Set(t)
+	return nil
+}
@@ -2,33 +2,94 @@ package client
 
 import (
 	"fmt"
+	"github.com/BaiMeow/aict/proto"
 	"golang.org/x/net/icmp"
+	"log/slog"
 	"math"
 	"math/rand/v2"
 	"net"
+	"time"
 )
 
 type Config struct {
-	Identify       int
-	minAirSeqCount int
-	maxAirSeqCount int
+	Identify int
+	// PSK enables encryption with the pre-shared key if not empty
+	PSK []byte
+	// Unprivileged uses icmp datagram sockets (linux ping sockets) instead of raw sockets,
+	// which needs net.ipv4.ping_group_range to include the group of the process.
+	// The kernel rewrites the echo id to the local port, Identify is overridden.
+	Unprivileged bool
+	// EchoSize is the max size of icmp echo data, larger packets are fragmented
+	EchoSize int
+	// PathMTUDiscovery probes the largest echo size up to EchoSize and announces it to server
+	PathMTUDiscovery bool
+	// PingInterval is the interval of pings measuring Stats, 0 means 1s, negative disables pings
+	PingInterval time.Duration
+	// DeadTimeout is how long without ping replies the peer is taken as dead,
+	// 0 means 15s, negative disables it. It needs pings enabled.
+	DeadTimeout time.Duration
+	// Compression deflates packets that shrink, if the server supports it
+	Compression bool
+	// Reconnect redials a dead peer with a fresh Identify instead of closing with ErrPeerDead
+	Reconnect bool
+	// Pacer paces echo requests, nil uses NewAIMDPacer
+	Pacer Pacer
+	// MinAirSeqCount and MaxAirSeqCount bound the echo requests kept waiting
+	// on server for replies, 0 means 1 and 32
+	MinAirSeqCount int
+	MaxAirSeqCount int
+	// Logger receives the logs of the conn with the peer attached, nil uses slog.Default
+	Logger *slog.Logger
+
+	cipher *proto.Cipher
 }
 
 func Dial(laddr *net.IPAddr, raddr *net.IPAddr, cfg *Config) (*AictConn, error) {
-	conn, err := icmp.ListenPacket("ip4:icmp", laddr.String())
+	if len(cfg.PSK) > 0 {
+		var err error
+		cfg.cipher, err = proto.NewCipher(cfg.PSK, proto.ClientToServer)
+		if err != nil {
+			return nil, fmt.Errorf("aict: cipher: %v", err)
+		}
+	}
+
+	family := proto.FamilyOf(raddr.IP)
+	if proto.FamilyOf(laddr.IP) != family {
+		return nil, fmt.Errorf("icmp: address family of %s and %s mismatch", laddr, raddr)
+	}
+	network := family.Network
+	if cfg.Unprivileged {
+		network = family.DatagramNetwork
+	}
+	conn, err := icmp.ListenPacket(network, laddr.String())
 	if err != nil {
 		return nil, fmt.Errorf("icmp: listen: %v", err)
 	}
 
+	if cfg.Unprivileged {
+		udpAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+		if !ok {
+			_ = conn.Close()
+			return nil, fmt.Errorf("icmp: datagram socket without port")
+		}
+		cfg.Identify = udpAddr.Port
+	}
 	if cfg.Identify == 0 {
 		cfg.Identify = rand.IntN(math.MaxUint16)
 	}
-	if cfg.minAirSeqCount == 0 {
-		cfg.minAirSeqCount = 1
+	if cfg.MinAirSeqCount == 0 {
+		cfg.MinAirSeqCount = 1
+	}
+	if cfg.EchoSize == 0 {
+		cfg.EchoSize = 1400
+	}
+	if cfg.MaxAirSeqCount == 0 {
+		cfg.MaxAirSeqCount = 32
 	}
-	if cfg.maxAirSeqCount == 0 {
-		cfg.maxAirSeqCount = 32
+	if cfg.MinAirSeqCount < 0 || cfg.MaxAirSeqCount < cfg.MinAirSeqCount {
+		_ = conn.Close()
+		return nil, fmt.Errorf("aict: invalid air seq count range [%d, %d]", cfg.MinAirSeqCount, cfg.MaxAirSeqCount)
 	}
 
-	return newAict(conn, raddr, cfg), nil
+	return newAict(conn, laddr, raddr, cfg), nil
 }
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"fmt"
+	"github.com/BaiMeow/aict/proto"
+	"math/rand/v2"
+	"time"
+)
+
+func newSession() uint32 {
+	for {
+		if s := rand.Uint32(); s != 0 {
+			return s
+		}
+	}
+}
+
+// startHandshake queues the handshake of a new session ahead of later packets,
+// since the server drops them before the session starts
+func (c *AictConn) startHandshake() {
+	session := newSession()
+	c.session.Store(session)
+	select {
+	case c.writeBuffer <- packet{layer: c.handshakeLayer(session)}:
+	default:
+		// full, sent on retry
+	}
+	go c.handshake(session)
+}
+
+func (c *AictConn) handshakeLayer(session uint32) proto.Layer {
+	h := proto.Handshake{Version: proto.Version, Capabilities: c.capabilities(), Session: session}
+	return proto.Layer{Flags: proto.FlagHandshake, Payload: h.Marshal()}
+}
+
+// handshake waits for the reply of the queued handshake, retried on loss.
+// It gives up if a newer session starts.
+func (c *AictConn) handshake(session uint32) {
+	for i := 0; i < probeRetries; i++ {
+		if i > 0 {
+			if c.session.Load() != session {
+				return
+			}
+			select {
+			case <-c.ctx.Done():
+				return
+			case c.writeBuffer <- packet{layer: c.handshakeLayer(session)}:
+			}
+		}
+		timer := time.NewTimer(probeTimeout)
+	Wait:
+		select {
+		case <-c.ctx.Done():
+			timer.Stop()
+			return
+		case reply := <-c.handshakeOK:
+			if reply.Session != session {
+				// reply of an older handshake
+				goto Wait
+			}
+			timer.Stop()
+			if reply.Version < proto.MinVersion || reply.Version > proto.Version {
+				c.log.Error("handshake", "session", fmt.Sprintf("%08x", session), "version", reply.Version, "err", proto.ErrVersion)
+				return
+			}
+			c.version.Store(uint32(reply.Version))
+			c.caps.Store(uint32(reply.Capabilities))
+			c.log.Info("session started", "session", fmt.Sprintf("%08x", session), "version", reply.Version)
+			if c.pmtuDiscovery {
+				c.pmtu.once.Do(func() {
+					go c.discoverPathMTU()
+				})
+			}
+			return
+		case <-timer.C:
+		}
+	}
+	c.log.Warn("no handshake reply", "session", fmt.Sprintf("%08x", session))
+}
+
+// capabilities of the client
+func (c *AictConn) capabilities() uint8 {
+	caps := uint8(proto.CapFragmentation)
+	if c.cipher != nil {
+		caps |= proto.CapEncryption
+	}
+	if c.compression {
+		caps |= proto.CapCompression
+	}
+	return caps
+}
+
+// handshakeReply handles the reply of handshake
+func (c *AictConn) handshakeReply(msg *proto.Layer) {
+	var h proto.Handshake
+	if err := h.Unmarshal(msg.Payload); err != nil {
+		return
+	}
+	select {
+	case c.handshakeOK <- h:
+	default:
+	}
+}
@@ -0,0 +1,169 @@
+package client
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"sync"
+	"time"
+)
+
+const (
+	// flightLen is how many echo requests are tracked for rtt and loss
+	flightLen = 1024
+
+	aimdInitialRate = float64(time.Second / RTT)
+	aimdMinRate     = 10
+	aimdMaxRate     = 10000
+	aimdDecrease    = 0.7
+	// aimdMinRTTWindow is how long a min rtt sample is kept
+	aimdMinRTTWindow = 10 * time.Second
+)
+
+// Pacer decides when the next echo request, data or keepalive, may be sent.
+type Pacer interface {
+	// Wait blocks until an echo request may be sent
+	Wait(ctx context.Context) error
+	// OnReply is called for every echo reply with the time since its request was sent,
+	// which includes how long the server held the id/seq pair.
+	OnReply(rtt time.Duration)
+	// OnLoss is called when n echo requests or their replies are considered lost
+	OnLoss(n int)
+}
+
+// BatchPacer is a Pacer which tells if an echo request may be sent right now,
+// so queued requests are sent in a batch without Wait. Allow takes the chance like Wait.
+type BatchPacer interface {
+	Pacer
+	Allow() bool
+}
+
+// AIMDPacer grows the rate of echo requests additively on replies,
+// like one more packet per rtt, and shrinks it multiplicatively on loss,
+// at most once per rtt.
+type AIMDPacer struct {
+	lock     sync.Mutex
+	limiter  *rate.Limiter
+	rate     float64
+	minRTT   time.Duration
+	minRTTAt time.Time
+	// decreasedAt is the time of the last decrease
+	decreasedAt time.Time
+}
+
+// NewAIMDPacer starts at 100 echo requests per second
+func NewAIMDPacer() *AIMDPacer {
+	return &AIMDPacer{
+		limiter: rate.NewLimiter(rate.Limit(aimdInitialRate), 1),
+		rate:    aimdInitialRate,
+		minRTT:  RTT,
+	}
+}
+
+func (p *AIMDPacer) Wait(ctx context.Context) error {
+	return p.limiter.Wait(ctx)
+}
+
+func (p *AIMDPacer) Allow() bool {
+	return p.limiter.Allow()
+}
+
+func (p *AIMDPacer) OnReply(rtt time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	// the server holds pairs until it has data, so only the min rtt is trusted
+	if rtt > 0 && (rtt <= p.minRTT || now.Sub(p.minRTTAt) > aimdMinRTTWindow) {
+		p.minRTT = rtt
+		p.minRTTAt = now
+	}
+	rttSec := p.minRTT.Seconds()
+	p.set(p.rate + 1/(p.rate*rttSec*rttSec))
+}
+
+func (p *AIMDPacer) OnLoss(n int) {
+	if n <= 0 {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	if now.Sub(p.decreasedAt) < p.minRTT {
+		// losses of the same window
+		return
+	}
+	p.decreasedAt = now
+	p.set(p.rate * aimdDecrease)
+}
+
+// Rate is the current echo requests per second
+func (p *AIMDPacer) Rate() float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.rate
+}
+
+func (p *AIMDPacer) set(r float64) {
+	p.rate = min(max(r, aimdMinRate), aimdMaxRate)
+	p.limiter.SetLimit(rate.Limit(p.rate))
+}
+
+// flight tracks the send time of echo requests by seq.
+// The server replies with pairs in the order they are queued,
+// so an unreplied request older than a reply is lost or discarded by server.
+type flight struct {
+	lock    sync.Mutex
+	entries [flightLen]flightEntry
+	// replied is the seq of the latest reply from the queue
+	replied uint16
+}
+
+type flightEntry struct {
+	seq    uint16
+	sentAt time.Time
+	// ping is replied at once instead of from the queue
+	ping bool
+}
+
+// reset forgets all requests
+func (f *flight) reset() {
+	f.lock.Lock()
+	f.entries = [flightLen]flightEntry{}
+	f.replied = 0
+	f.lock.Unlock()
+}
+
+func (f *flight) sent(seq uint16, ping bool) {
+	f.lock.Lock()
+	f.entries[seq%flightLen] = flightEntry{seq: seq, sentAt: time.Now(), ping: ping}
+	f.lock.Unlock()
+}
+
+// reply returns the rtt of seq, 0 if unknown,
+// and how many queued requests before seq got no reply
+func (f *flight) reply(seq uint16) (rtt time.Duration, skipped int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	e := &f.entries[seq%flightLen]
+	if e.seq != seq || e.sentAt.IsZero() {
+		// unknown, reordered or overwritten
+		return 0, 0
+	}
+	rtt = time.Since(e.sentAt)
+	ping := e.ping
+	*e = flightEntry{}
+	if ping {
+		return rtt, 0
+	}
+	gap := seq - f.replied
+	if gap < flightLen {
+		for s := f.replied + 1; s != seq; s++ {
+			g := &f.entries[s%flightLen]
+			if g.seq == s && !g.sentAt.IsZero() && !g.ping {
+				skipped++
+				*g = flightEntry{}
+			}
+		}
+	}
+	f.replied = seq
+	return rtt, skipped
+}
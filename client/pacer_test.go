@@ -0,0 +1,43 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlight(t *testing.T) {
+	var f flight
+	for seq := uint16(1); seq <= 5; seq++ {
+		f.sent(seq, seq == 3)
+	}
+	if rtt, skipped := f.reply(3); rtt <= 0 || skipped != 0 {
+		t.Fatalf("ping reply: %v %d", rtt, skipped)
+	}
+	if _, skipped := f.reply(1); skipped != 0 {
+		t.Fatalf("skipped %d", skipped)
+	}
+	// 2 and 4 got no reply, 3 is a ping
+	if _, skipped := f.reply(5); skipped != 2 {
+		t.Fatalf("skipped %d", skipped)
+	}
+	if rtt, _ := f.reply(2); rtt != 0 {
+		t.Fatal("late reply is known")
+	}
+}
+
+func TestAIMDPacer(t *testing.T) {
+	p := NewAIMDPacer()
+	start := p.Rate()
+	for i := 0; i < 10; i++ {
+		p.OnReply(50 * time.Millisecond)
+	}
+	grown := p.Rate()
+	if grown <= start {
+		t.Fatalf("rate %f not grown from %f", grown, start)
+	}
+	p.OnLoss(3)
+	p.OnLoss(1)
+	if r := p.Rate(); r != grown*aimdDecrease {
+		t.Fatalf("rate %f, want one decrease from %f", r, grown)
+	}
+}
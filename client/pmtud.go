@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"github.com/BaiMeow/aict/proto"
+	"sync"
+	"time"
+)
+
+const (
+	probeTimeout = time.Second
+	probeRetries = 3
+	minEchoSize  = 256
+)
+
+// pathMTU is the state of path mtu discovery
+type pathMTU struct {
+	lock    sync.Mutex
+	once    sync.Once
+	probeID uint16
+	// waiting receives the rtt of the reply, 0 if unknown
+	waiting map[uint16]chan time.Duration
+	done    chan struct{}
+}
+
+// discoverPathMTU binary searches the largest echo size which gets a reply,
+// then announces it to the server with a last probe. The configured size is
+// kept if no probe gets a reply.
+func (c *AictConn) discoverPathMTU() {
+	defer close(c.pmtu.done)
+	lo, hi := min(minEchoSize, c.echoSize), c.echoSize
+	found := c.probe(hi, 0)
+	if found {
+		lo = hi
+	} else {
+		for lo < hi {
+			mid := (lo + hi + 1) / 2
+			if c.probe(mid, 0) {
+				lo, found = mid, true
+			} else {
+				hi = mid - 1
+			}
+		}
+		// the search never probes the lower bound itself
+		if !found {
+			found = c.probe(lo, 0)
+		}
+	}
+	select {
+	case <-c.ctx.Done():
+		return
+	default:
+	}
+	if !found {
+		c.log.Warn("path mtu discovery failed, keep echo size", "echoSize", c.echoSize)
+		return
+	}
+	c.setEchoSize(lo)
+	c.log.Info("path mtu discovered", "echoSize", lo, "packetSize", c.PathMTU())
+	c.probe(min(minEchoSize, lo), lo)
+}
+
+// probe sends a padded ping of echo data size and waits for the reply, retried on loss
+func (c *AictConn) probe(size int, announce int) bool {
+	for i := 0; i < probeRetries; i++ {
+		if _, ok := c.ping(size, announce); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ping sends a ping padded to echo data size and returns the rtt,
+// false if no reply in probeTimeout. A size of 0 sends no padding.
+func (c *AictConn) ping(size int, announce int) (time.Duration, bool) {
+	c.pmtu.lock.Lock()
+	c.pmtu.probeID++
+	p := proto.Probe{ID: c.pmtu.probeID, EchoSize: uint16(announce)}
+	replied := make(chan time.Duration, 1)
+	c.pmtu.waiting[p.ID] = replied
+	c.pmtu.lock.Unlock()
+
+	layer := proto.Layer{Flags: proto.FlagPing, Payload: p.Marshal(size - c.overhead())}
+	start := time.Now()
+	select {
+	case <-c.ctx.Done():
+		return 0, false
+	case c.writeBuffer <- packet{layer: layer}:
+	}
+
+	timer := time.NewTimer(probeTimeout)
+	select {
+	case <-c.ctx.Done():
+		timer.Stop()
+		return 0, false
+	case rtt := <-replied:
+		timer.Stop()
+		if rtt == 0 {
+			// includes the time in write queue
+			rtt = time.Since(start)
+		}
+		return rtt, true
+	case <-timer.C:
+	}
+	c.pmtu.lock.Lock()
+	delete(c.pmtu.waiting, p.ID)
+	c.pmtu.lock.Unlock()
+	return 0, false
+}
+
+// pong handles the reply of ping, rtt is measured from the echo request, 0 if unknown
+func (c *AictConn) pong(msg *proto.Layer, rtt time.Duration) {
+	var p proto.Probe
+	if err := p.Unmarshal(msg.Payload); err != nil {
+		return
+	}
+	c.pmtu.lock.Lock()
+	defer c.pmtu.lock.Unlock()
+	if replied, ok := c.pmtu.waiting[p.ID]; ok {
+		delete(c.pmtu.waiting, p.ID)
+		replied <- rtt
+	}
+}
+
+// overhead is the bytes of echo data besides layer payload
+func (c *AictConn) overhead() int {
+	if c.cipher == nil {
+		return proto.HeaderLen
+	}
+	return proto.HeaderLen + c.cipher.Overhead()
+}
+
+func (c *AictConn) setEchoSize(size int) {
+	c.maxPayload.Store(int32(size - c.overhead()))
+}
+
+// PathMTU is the largest packet sent in a single echo, larger ones are fragmented
+func (c *AictConn) PathMTU() int {
+	return int(c.maxPayload.Load())
+}
+
+// WaitPathMTU waits for path mtu discovery and returns PathMTU,
+// it returns at once if discovery is disabled.
+func (c *AictConn) WaitPathMTU(ctx context.Context) int {
+	select {
+	case <-ctx.Done():
+	case <-c.pmtu.done:
+	}
+	return c.PathMTU()
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BaiMeow/aict/proto"
+	"golang.org/x/net/icmp"
+	"math"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+const (
+	defaultDeadTimeout = 15 * time.Second
+	minRedialBackoff   = 2 * time.Second
+	maxRedialBackoff   = time.Minute
+)
+
+var (
+	ErrClosed     = errors.New("connection closed")
+	ErrPeerDead   = errors.New("aict: no reply from peer")
+	ErrPeerClosed = errors.New("aict: closed by peer")
+	ErrTakenOver  = errors.New("aict: session taken over by another client")
+)
+
+// socket is the icmp socket and the echo id used on it
+type socket struct {
+	conn     *proto.BatchConn
+	identify int
+}
+
+// watchdog redials when there is no reply in timeout, retried with
+// exponential backoff until a reply comes. If Config.Reconnect is false,
+// the conn is closed with ErrPeerDead instead.
+func (c *AictConn) watchdog(timeout time.Duration) {
+	var (
+		deadline  = timeout
+		backoff   = minRedialBackoff
+		redialed  time.Time
+		lastReply time.Time
+	)
+	for {
+		lastReply = time.Unix(0, c.lastReply.Load())
+		if lastReply.After(redialed) && !redialed.IsZero() {
+			// alive again
+			c.log.Info("peer replies again")
+			deadline, backoff, redialed = timeout, minRedialBackoff, time.Time{}
+		}
+		since := lastReply
+		if redialed.After(since) {
+			since = redialed
+		}
+		if wait := time.Until(since.Add(deadline)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-c.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			continue
+		}
+
+		if !c.reconnect {
+			c.log.Warn("no reply", "timeout", deadline)
+			c.closeWithError(ErrPeerDead)
+			return
+		}
+		c.log.Warn("no reply, redial", "timeout", deadline)
+		if err := c.redial(); err != nil {
+			c.log.Error("redial", "err", err)
+		}
+		redialed = time.Now()
+		deadline = backoff
+		backoff = min(backoff*2, maxRedialBackoff)
+	}
+}
+
+// redial starts over with a fresh echo id and sequence base, so the server
+// takes it as a new session. Datagram sockets are reopened to get a new id.
+func (c *AictConn) redial() error {
+	c.redialLock.Lock()
+	defer c.redialLock.Unlock()
+	old := c.sock.Load()
+	s := &socket{conn: old.conn}
+	if c.unprivileged {
+		conn, err := icmp.ListenPacket(c.family.DatagramNetwork, c.laddr.String())
+		if err != nil {
+			return fmt.Errorf("listen: %v", err)
+		}
+		udpAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+		if !ok {
+			_ = conn.Close()
+			return fmt.Errorf("datagram socket without port")
+		}
+		s = &socket{conn: proto.NewBatchConn(conn), identify: udpAddr.Port}
+	} else {
+		for s.identify == 0 || s.identify == old.identify {
+			s.identify = rand.IntN(math.MaxUint16)
+		}
+	}
+
+	c.sequence.Store(rand.Uint32())
+	c.peerSequence.Store(c.sequence.Load())
+	c.readCounter.Store(0)
+	c.peerCredit.Store(nil)
+	c.flight.reset()
+	c.sock.Store(s)
+
+	if s.conn != old.conn {
+		if err := old.conn.Close(); err != nil {
+			c.log.Warn("close", "err", err)
+		}
+	}
+	select {
+	case <-c.ctx.Done():
+		// lost the race with Close
+		return s.conn.Close()
+	default:
+	}
+	c.log.Info("redial", "id", s.identify)
+	c.startHandshake()
+	return nil
+}
+
+// peerClosed handles FlagClose from server, like an idle timeout.
+// A session taken over by another client is not redialed,
+// or the two clients would take it from each other forever.
+func (c *AictConn) peerClosed(payload []byte) {
+	if len(payload) > 0 && payload[0] == proto.CloseTakenOver {
+		c.log.Warn("session taken over by another client")
+		c.closeWithError(ErrTakenOver)
+		return
+	}
+	if !c.reconnect {
+		c.log.Info("closed by peer")
+		c.closeWithError(ErrPeerClosed)
+		return
+	}
+	c.log.Info("closed by peer, redial")
+	if err := c.redial(); err != nil {
+		c.log.Error("redial", "err", err)
+	}
+}
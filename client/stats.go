@@ -0,0 +1,96 @@
+package client
+
+import (
+	"github.com/BaiMeow/aict/metrics"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPingInterval = time.Second
+	// lossGain is the weight of the latest ping in Stats.Loss
+	lossGain = 1.0 / 8
+)
+
+// Stats are measured by pings, which the server replies right away
+type Stats struct {
+	// RTT is the smoothed round trip time, 0 before the first reply
+	RTT    time.Duration
+	RTTVar time.Duration
+	// Sent and Lost count pings, a ping is lost without reply in probeTimeout
+	Sent uint64
+	Lost uint64
+	// Loss is the moving average of the lost ratio of recent pings
+	Loss float64
+	// LastReply is the time of the last ping reply
+	LastReply time.Time
+}
+
+type stats struct {
+	lock sync.Mutex
+	s    Stats
+}
+
+// record updates stats with a ping, rtt is ignored if lost
+func (st *stats) record(rtt time.Duration, lost bool) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	s := &st.s
+	s.Sent++
+	if lost {
+		s.Lost++
+		s.Loss += (1 - s.Loss) * lossGain
+		return
+	}
+	s.Loss -= s.Loss * lossGain
+	s.LastReply = time.Now()
+	// rfc 6298
+	if s.RTT == 0 {
+		s.RTT = rtt
+		s.RTTVar = rtt / 2
+		return
+	}
+	diff := s.RTT - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	s.RTTVar = (3*s.RTTVar + diff) / 4
+	s.RTT = (7*s.RTT + rtt) / 8
+}
+
+// pinger sends a ping every interval until the conn is closed
+func (c *AictConn) pinger(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+		}
+		rtt, ok := c.ping(0, 0)
+		select {
+		case <-c.ctx.Done():
+			return
+		default:
+		}
+		c.stats.record(rtt, !ok)
+	}
+}
+
+// Stats returns the rtt and loss measured by pings
+func (c *AictConn) Stats() Stats {
+	c.stats.lock.Lock()
+	defer c.stats.lock.Unlock()
+	return c.stats.s
+}
+
+// Metrics returns the counters of echoes and the gauges of queues
+func (c *AictConn) Metrics() metrics.Snapshot {
+	s := c.metrics.Snapshot()
+	s.SeqQueueDepth = int(c.peerDepth.Load())
+	s.AirSeqCount = int(c.airSeqCount.Load())
+	s.ReadQueue = len(c.readBuffer)
+	s.WriteQueue = len(c.writeBuffer)
+	return s
+}
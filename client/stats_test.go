@@ -0,0 +1,23 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	var st stats
+	st.record(100*time.Millisecond, false)
+	st.record(0, true)
+	st.record(60*time.Millisecond, false)
+	s := st.s
+	if s.Sent != 3 || s.Lost != 1 {
+		t.Fatalf("sent %d lost %d", s.Sent, s.Lost)
+	}
+	if s.RTT != 95*time.Millisecond || s.RTTVar != 47500*time.Microsecond {
+		t.Fatalf("rtt %v rttvar %v", s.RTT, s.RTTVar)
+	}
+	if s.Loss <= 0 || s.Loss >= lossGain {
+		t.Fatalf("loss %f", s.Loss)
+	}
+}
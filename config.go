@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	roleClient = "client"
+	roleServer = "server"
+)
+
+// Tunnel is a client or server with its pipe, from the flags or a config file.
+// JSON keys are the flag names.
+type Tunnel struct {
+	// Name tells tunnels apart in logs
+	Name string `json:"name"`
+	// Role is client or server
+	Role string `json:"role"`
+	// Local is the listen addr, empty means the unspecified addr of the family of Remote
+	Local    string `json:"local"`
+	Remote   string `json:"remote"`
+	Pipe     string `json:"pipe"`
+	PSK      string `json:"psk"`
+	EchoSize int    `json:"echoSize"`
+	Compress bool   `json:"compress"`
+
+	// tun pipe
+	MTU     int      `json:"mtu"`
+	Address string   `json:"addr"`
+	Routes  []string `json:"routes"`
+
+	// client
+	Unprivileged     bool     `json:"unprivileged"`
+	PathMTUDiscovery bool     `json:"pmtud"`
+	DeadTimeout      Duration `json:"deadTimeout"`
+	MinAirSeqCount   int      `json:"minAirSeqCount"`
+	MaxAirSeqCount   int      `json:"maxAirSeqCount"`
+
+	// server
+	SeqQueueSize int      `json:"seqQueueSize"`
+	MaxSessions  int      `json:"maxSessions"`
+	SeqTTL       Duration `json:"seqTTL"`
+	IdleTimeout  Duration `json:"idleTimeout"`
+}
+
+// Duration is time.Duration written like "15s" in config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration: %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// defaultTunnel has the defaults of flags
+func defaultTunnel() *Tunnel {
+	return &Tunnel{
+		Remote:         "0.0.0.0",
+		Pipe:           "tun",
+		EchoSize:       1400,
+		MTU:            defaultMTU,
+		DeadTimeout:    Duration(15 * time.Second),
+		MinAirSeqCount: 1,
+		MaxAirSeqCount: 32,
+		SeqQueueSize:   10,
+		MaxSessions:    256,
+		SeqTTL:         Duration(25 * time.Second),
+		IdleTimeout:    Duration(time.Minute),
+	}
+}
+
+// check validates the tunnel
+func (t *Tunnel) check() error {
+	if t.Role != roleClient && t.Role != roleServer {
+		return fmt.Errorf("unknown role %q, client or server", t.Role)
+	}
+	if t.Pipe == "" {
+		return errors.New("empty pipe")
+	}
+	return nil
+}
+
+// configFile is the config file, like
+//
+//	{"metrics": "127.0.0.1:9100", "log-level": "info", "tunnels": [{"name": "wg", "role": "client", "remote": "1.2.3.4", "pipe": "udp:51820"}]}
+type configFile struct {
+	Metrics  string            `json:"metrics"`
+	LogLevel string            `json:"log-level"`
+	Tunnels  []json.RawMessage `json:"tunnels"`
+}
+
+// config is a loaded config file
+type config struct {
+	// Metrics is the listen addr of /metrics, empty disables it
+	Metrics  string
+	LogLevel slog.Level
+	Tunnels  []*Tunnel
+}
+
+// loadConfig reads the config file at path,
+// fields of tunnels not set in it take the defaults of flags
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg configFile
+	if err := decodeStrict(data, &cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Tunnels) == 0 {
+		return nil, errors.New("no tunnels")
+	}
+	level := slog.LevelInfo
+	if cfg.LogLevel != "" {
+		if level, err = parseLevel(cfg.LogLevel); err != nil {
+			return nil, err
+		}
+	}
+
+	names := make(map[string]bool)
+	tunnels := make([]*Tunnel, 0, len(cfg.Tunnels))
+	for i, raw := range cfg.Tunnels {
+		t := defaultTunnel()
+		if err := decodeStrict(raw, t); err != nil {
+			return nil, fmt.Errorf("tunnel %d: %v", i, err)
+		}
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("tunnel%d", i)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("tunnel %d: duplicate name %q", i, t.Name)
+		}
+		names[t.Name] = true
+		if err := t.check(); err != nil {
+			return nil, fmt.Errorf("tunnel %s: %v", t.Name, err)
+		}
+		tunnels = append(tunnels, t)
+	}
+	return &config{Metrics: cfg.Metrics, LogLevel: level, Tunnels: tunnels}, nil
+}
+
+// parseLevel parses debug, info, warn or error
+func parseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, err
+	}
+	return level, nil
+}
+
+// decodeStrict unmarshals data into v, unknown fields are errors to catch typos
+func decodeStrict(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aict.json")
+	data := `{"metrics": "127.0.0.1:9100", "log-level": "debug", "tunnels": [
+		{"name": "wg", "role": "client", "remote": "192.0.2.1", "pipe": "udp:51820", "deadTimeout": "30s", "maxAirSeqCount": 64},
+		{"role": "server", "pipe": "tun:tun1", "addr": "10.0.0.1/32", "routes": ["10.0.0.2/32"]}
+	]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Tunnels) != 2 || cfg.Metrics != "127.0.0.1:9100" || cfg.LogLevel != slog.LevelDebug {
+		t.Fatalf("config %+v", cfg)
+	}
+	wg, srv := cfg.Tunnels[0], cfg.Tunnels[1]
+	if wg.Name != "wg" || wg.DeadTimeout != Duration(30*time.Second) || wg.MaxAirSeqCount != 64 || wg.MinAirSeqCount != 1 || wg.EchoSize != 1400 {
+		t.Fatalf("client tunnel %+v", wg)
+	}
+	if srv.Name != "tunnel1" || srv.Role != roleServer || len(srv.Routes) != 1 || srv.IdleTimeout != Duration(time.Minute) {
+		t.Fatalf("server tunnel %+v", srv)
+	}
+
+	for _, bad := range []string{
+		`{"tunnels": []}`,
+		`{"log-level": "verbose", "tunnels": [{"role": "client"}]}`,
+		`{"tunnels": [{"role": "peer"}]}`,
+		`{"tunnels": [{"role": "client", "remtoe": "192.0.2.1"}]}`,
+		`{"tunnels": [{"role": "client", "deadTimeout": 15}]}`,
+		`{"tunnels": [{"name": "a", "role": "client"}, {"name": "a", "role": "server"}]}`,
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(path); err == nil {
+			t.Fatalf("invalid config loaded: %s", bad)
+		}
+	}
+}
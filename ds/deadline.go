@@ -0,0 +1,67 @@
+package ds
+
+import (
+	"sync"
+	"time"
+)
+
+// Deadline is a deadline settable at any time like those of net.Conn,
+// Done is closed once it passes. The zero value is not usable, see NewDeadline.
+type Deadline struct {
+	lock  sync.Mutex
+	timer *time.Timer
+	// done is closed when the deadline passes, replaced by a later deadline
+	done chan struct{}
+}
+
+func NewDeadline() *Deadline {
+	return &Deadline{done: make(chan struct{})}
+}
+
+// Set sets the deadline, zero means no deadline
+func (d *Deadline) Set(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// the timer fired, wait for it to close done
+		<-d.done
+	}
+	d.timer = nil
+
+	closed := isClosed(d.done)
+	if t.IsZero() {
+		if closed {
+			d.done = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.done = make(chan struct{})
+		}
+		done := d.done
+		d.timer = time.AfterFunc(dur, func() {
+			close(done)
+		})
+		return
+	}
+	if !closed {
+		close(d.done)
+	}
+}
+
+// Done returns a chan closed once the deadline passes
+func (d *Deadline) Done() <-chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.done
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,43 @@
+package ds
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadline(t *testing.T) {
+	d := NewDeadline()
+	select {
+	case <-d.Done():
+		t.Fatal("no deadline passed")
+	default:
+	}
+
+	d.Set(time.Now().Add(20 * time.Millisecond))
+	select {
+	case <-d.Done():
+	case <-time.After(time.Second):
+		t.Fatal("deadline not passed")
+	}
+
+	// extended after it passed
+	d.Set(time.Now().Add(time.Hour))
+	select {
+	case <-d.Done():
+		t.Fatal("extended deadline passed")
+	default:
+	}
+
+	d.Set(time.Now().Add(-time.Second))
+	select {
+	case <-d.Done():
+	default:
+		t.Fatal("past deadline not passed")
+	}
+	d.Set(time.Time{})
+	select {
+	case <-d.Done():
+		t.Fatal("cleared deadline passed")
+	default:
+	}
+}
@@ -0,0 +1,100 @@
+package ds
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type stamped[T any] struct {
+	v T
+	t time.Time
+}
+
+// ExpiringQueue is a RotatedQueue skipping elements older than ttl on pop.
+// Push must be called by only one writer, consumers are serialized.
+type ExpiringQueue[T any] struct {
+	q    *RotatedQueue[stamped[T]]
+	size int
+	ttl  time.Duration
+	// dropped counts elements discarded for being stale or pushed out of a full queue
+	dropped atomic.Uint64
+	// lock serializes consumers, Push is lock free
+	lock sync.Mutex
+}
+
+// NewExpiringQueue size must be pow of 2, ttl <= 0 means never expire
+func NewExpiringQueue[T any](size int, ttl time.Duration) *ExpiringQueue[T] {
+	return &ExpiringQueue[T]{
+		q:    NewRotatedQueue[stamped[T]](size),
+		size: size,
+		ttl:  ttl,
+	}
+}
+
+func (e *ExpiringQueue[T]) Push(v T) {
+	if e.q.Len() == e.size {
+		// the oldest one is eaten
+		e.dropped.Add(1)
+	}
+	e.q.Push(stamped[T]{v: v, t: time.Now()})
+}
+
+// TryPop returns the oldest fresh element, stale ones are discarded
+func (e *ExpiringQueue[T]) TryPop() (T, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	now := time.Now()
+	for {
+		s, ok := e.q.TryPop()
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		if e.fresh(s, now) {
+			return s.v, true
+		}
+		e.dropped.Add(1)
+	}
+}
+
+// PopContext parks until a fresh element is pushed or ctx is done
+func (e *ExpiringQueue[T]) PopContext(ctx context.Context) (T, error) {
+	for {
+		if v, ok := e.TryPop(); ok {
+			return v, nil
+		}
+		if err := e.q.Wait(ctx); err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+}
+
+// Fresh discards stale elements and returns the count of the rest
+func (e *ExpiringQueue[T]) Fresh() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	now := time.Now()
+	for {
+		// elements are pushed in time order, only the head can be stale
+		s, ok := e.q.Peek()
+		if !ok || e.fresh(s, now) {
+			break
+		}
+		e.q.TryPop()
+		e.dropped.Add(1)
+	}
+	return e.q.Len()
+}
+
+// Dropped is the count of elements discarded without being popped, it may be
+// off by one if a pop races with a push into a full queue
+func (e *ExpiringQueue[T]) Dropped() uint64 {
+	return e.dropped.Load()
+}
+
+func (e *ExpiringQueue[T]) fresh(s stamped[T], now time.Time) bool {
+	return e.ttl <= 0 || now.Sub(s.t) < e.ttl
+}
@@ -0,0 +1,37 @@
+package ds
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiringQueue(t *testing.T) {
+	q := NewExpiringQueue[int](8, 30*time.Millisecond)
+	q.Push(1)
+	q.Push(2)
+	time.Sleep(40 * time.Millisecond)
+	q.Push(3)
+	if n := q.Fresh(); n != 1 {
+		t.Fatalf("fresh %d", n)
+	}
+	if v, ok := q.TryPop(); !ok || v != 3 {
+		t.Fatalf("pop %d %v", v, ok)
+	}
+
+	q.Push(4)
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := q.TryPop(); ok {
+		t.Fatal("popped stale element")
+	}
+	if n := q.Dropped(); n != 3 {
+		t.Fatalf("dropped %d", n)
+	}
+
+	full := NewExpiringQueue[int](4, 0)
+	for i := 0; i < 6; i++ {
+		full.Push(i)
+	}
+	if n := full.Dropped(); n != 2 {
+		t.Fatalf("dropped of full queue %d", n)
+	}
+}
@@ -0,0 +1,44 @@
+package ds
+
+import (
+	"sync"
+)
+
+// Buffer is a pooled byte slice, B may be resliced and is restored by Put
+type Buffer struct {
+	B []byte
+}
+
+// BufferPool recycles buffers of the same size.
+// Pointers are pooled, so Get and Put don't allocate.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func NewBufferPool(size int) *BufferPool {
+	p := &BufferPool{size: size}
+	p.pool.New = func() any {
+		return &Buffer{B: make([]byte, size)}
+	}
+	return p
+}
+
+// Get returns a buffer of len size
+func (p *BufferPool) Get() *Buffer {
+	return p.pool.Get().(*Buffer)
+}
+
+// Put recycles b, buffers smaller than size are dropped
+func (p *BufferPool) Put(b *Buffer) {
+	if b == nil || cap(b.B) < p.size {
+		return
+	}
+	b.B = b.B[:p.size]
+	p.pool.Put(b)
+}
+
+// Size is the len of buffers returned by Get
+func (p *BufferPool) Size() int {
+	return p.size
+}
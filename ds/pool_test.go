@@ -0,0 +1,28 @@
+package ds
+
+import (
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	p := NewBufferPool(16)
+	b := p.Get()
+	if len(b.B) != 16 {
+		t.Fatalf("len %d", len(b.B))
+	}
+	b.B = b.B[:3]
+	p.Put(b)
+	if b := p.Get(); len(b.B) != 16 {
+		t.Fatalf("len %d after put", len(b.B))
+	}
+	// smaller ones are not pooled
+	p.Put(&Buffer{B: make([]byte, 8)})
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	p := NewBufferPool(2048)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.Put(p.Get())
+	}
+}
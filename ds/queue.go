@@ -1,6 +1,7 @@
 package ds
 
 import (
+	"context"
 	"sync/atomic"
 )
 
@@ -15,6 +16,8 @@ type RotatedQueue[T any] struct {
 	buf    []T
 	len    uint64
 	cursor atomic.Value
+	// notify wakes up a parked PopContext
+	notify chan struct{}
 }
 
 // NewRotatedQueue len must be pow of 2
@@ -23,6 +26,7 @@ func NewRotatedQueue[T any](size int) *RotatedQueue[T] {
 		buf:    make([]T, size),
 		len:    uint64(size),
 		cursor: atomic.Value{},
+		notify: make(chan struct{}, 1),
 	}
 	q.cursor.Store(status{0, 0, 0, 0})
 	return q
@@ -73,14 +77,69 @@ LengthPlus1:
 	}) {
 		goto LengthPlus1
 	}
+	q.wake()
 }
 
+// Pop blocks until an element is available
 func (q *RotatedQueue[T]) Pop() T {
+	v, _ := q.PopContext(context.Background())
+	return v
+}
+
+// PopContext parks until an element is pushed or ctx is done
+func (q *RotatedQueue[T]) PopContext(ctx context.Context) (T, error) {
+	for {
+		if v, ok := q.TryPop(); ok {
+			return v, nil
+		}
+		if err := q.Wait(ctx); err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+}
+
+// Wait parks until the next Push or ctx is done, a Push between
+// a failed TryPop and Wait is not missed.
+func (q *RotatedQueue[T]) Wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-q.notify:
+		return nil
+	}
+}
+
+// Peek returns the head without removing it
+func (q *RotatedQueue[T]) Peek() (T, bool) {
+	for {
+		old := q.cursor.Load().(status)
+		if old.readLen == 0 {
+			var zero T
+			return zero, false
+		}
+		data := q.buf[old.readCursor]
+		// like TryPop, the read only counts if the cursor didn't move, a Push
+		// into a full queue may have eaten the head and overwritten it
+		if q.cursor.Load().(status) == old {
+			return data, true
+		}
+	}
+}
+
+// Len is the count of elements ready to pop
+func (q *RotatedQueue[T]) Len() int {
+	return int(q.cursor.Load().(status).readLen)
+}
+
+// TryPop returns false at once if the queue is empty
+func (q *RotatedQueue[T]) TryPop() (T, bool) {
 Read:
 	old := q.cursor.Load().(status)
 	if old.readLen == 0 {
 		// empty
-		goto Read
+		var zero T
+		return zero, false
 	}
 
 	data := q.buf[old.readCursor]
@@ -93,5 +152,16 @@ Read:
 		goto Read
 	}
 
-	return data
+	if old.readLen > 1 {
+		// pass the wakeup on to other parked poppers
+		q.wake()
+	}
+	return data, true
+}
+
+func (q *RotatedQueue[T]) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestQueue(t *testing.T) {
@@ -37,3 +38,56 @@ func TestQueue(t *testing.T) {
 	}
 	cancel()
 }
+
+func TestQueuePopContext(t *testing.T) {
+	q := NewRotatedQueue[int](4)
+	if _, ok := q.TryPop(); ok {
+		t.Fatal("pop from empty queue")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.PopContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	got := make(chan int)
+	for i := 0; i < 2; i++ {
+		go func() {
+			v, err := q.PopContext(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			got <- v
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	q.Push(1)
+	q.Push(2)
+	if a, b := <-got, <-got; a+b != 3 {
+		t.Fatalf("popped %d %d", a, b)
+	}
+}
+
+func TestQueuePeekFull(t *testing.T) {
+	q := NewRotatedQueue[int](4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for i := 1; ctx.Err() == nil; i++ {
+			q.Push(i)
+		}
+	}()
+	// the head only moves forward, an overwritten head would be newer than the next one
+	last := 0
+	for i := 0; i < 100000; i++ {
+		v, ok := q.Peek()
+		if !ok {
+			continue
+		}
+		if v < last {
+			t.Fatalf("peek %d after %d", v, last)
+		}
+		last = v
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BaiMeow/aict/mux"
+	"github.com/BaiMeow/aict/stream"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+type forwardRule struct {
+	listen string
+	target string
+}
+
+// parseForwardRules parses <listen>=<target>[,<listen>=<target>...]
+func parseForwardRules(arg string) ([]forwardRule, error) {
+	var rules []forwardRule
+	for _, r := range strings.Split(arg, ",") {
+		listen, target, ok := strings.Cut(strings.TrimSpace(r), "=")
+		if !ok || listen == "" || target == "" {
+			return nil, fmt.Errorf("invalid forward rule %q", r)
+		}
+		rules = append(rules, forwardRule{listen: listen, target: target})
+	}
+	return rules, nil
+}
+
+// forwardUp listens on the local addresses and the peer dials the targets, like ssh -L
+func forwardUp(conn Conn, logger *slog.Logger, arg string, client bool) error {
+	rules, err := parseForwardRules(arg)
+	if err != nil {
+		return fmt.Errorf("parse forward: %v", err)
+	}
+	// the peer has nothing to ask for
+	p := &proxyServer{session: mux.New(conn, client, &stream.Config{Logger: logger}), log: logger}
+	defer func() { _ = p.session.Close() }()
+	for _, rule := range rules {
+		ln, err := net.Listen("tcp", rule.listen)
+		if err != nil {
+			return fmt.Errorf("listen forward: %v", err)
+		}
+		defer func() { _ = ln.Close() }()
+		logger.Info("forward to peer", "listen", ln.Addr().String(), "target", rule.target)
+		go forwardListener(p.session, logger, ln, rule.target)
+	}
+	p.serve()
+	return errors.New("forward: tunnel closed")
+}
+
+// reverseUp asks the peer to listen on the remote addresses and dials the local targets, like ssh -R
+func reverseUp(conn Conn, logger *slog.Logger, arg string, client bool) error {
+	rules, err := parseForwardRules(arg)
+	if err != nil {
+		return fmt.Errorf("parse reverse: %v", err)
+	}
+	targets := make(map[string]bool)
+	for _, rule := range rules {
+		targets[rule.target] = true
+	}
+	p := &proxyServer{
+		session: mux.New(conn, client, &stream.Config{Logger: logger}),
+		log:     logger,
+		// only dial the targets we asked for
+		policy: proxyPolicy{connect: func(target string) bool { return targets[target] }},
+	}
+	defer func() { _ = p.session.Close() }()
+	for _, rule := range rules {
+		c, err := requestProxy(p.session, proxyCmdListen, rule.listen+"="+rule.target)
+		if err != nil {
+			return fmt.Errorf("reverse %s: %v", rule.listen, err)
+		}
+		_ = c.Close()
+		logger.Info("reverse from peer", "listen", rule.listen, "target", rule.target)
+	}
+	p.serve()
+	return errors.New("reverse: tunnel closed")
+}
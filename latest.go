@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/BaiMeow/aict/server"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// latestConn serves a single peer pipe with the latest client session,
+// so a new or redialing client takes over the pipe. Packets written
+// without a live session are dropped, reads wait for the next one.
+// Reads fail once the listener fails or is closed.
+type latestConn struct {
+	log  *slog.Logger
+	lock sync.Mutex
+	conn *server.AictConn
+	// changed is closed when conn is replaced
+	changed chan struct{}
+	// done is closed when the listener stops accepting, err is why
+	done chan struct{}
+	err  error
+}
+
+func newLatestConn(listener *server.Listener, logger *slog.Logger) *latestConn {
+	l := &latestConn{log: logger, changed: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				l.err = fmt.Errorf("server: accept: %v", err)
+				close(l.done)
+				return
+			}
+			l.lock.Lock()
+			old := l.conn
+			l.conn = c
+			close(l.changed)
+			l.changed = make(chan struct{})
+			l.lock.Unlock()
+			if old == nil {
+				continue
+			}
+			l.log.Info("client takes over", "peer", c.RemoteAddr().String(), "id", c.ID())
+			if err := old.Supersede(); err != nil {
+				l.log.Warn("close superseded session", "err", err)
+			}
+		}
+	}()
+	return l
+}
+
+func (l *latestConn) current() (*server.AictConn, chan struct{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.conn, l.changed
+}
+
+func (l *latestConn) ReadPacket() ([]byte, error) {
+	for {
+		c, changed := l.current()
+		if c != nil {
+			data, err := c.ReadPacket()
+			if err == nil {
+				return data, nil
+			}
+		}
+		// the session ended, wait for the next client
+		if err := l.wait(changed); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (l *latestConn) ReadPacketTo(buf []byte) (int, error) {
+	for {
+		c, changed := l.current()
+		if c != nil {
+			n, err := c.ReadPacketTo(buf)
+			if err == nil || errors.Is(err, io.ErrShortBuffer) {
+				return n, err
+			}
+		}
+		if err := l.wait(changed); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait waits for changed, it returns the error of the listener if it stops first
+func (l *latestConn) wait(changed chan struct{}) error {
+	select {
+	case <-changed:
+		return nil
+	case <-l.done:
+		return l.err
+	}
+}
+
+func (l *latestConn) WritePacket(data []byte) error {
+	if c, _ := l.current(); c != nil {
+		// an ended session drops it
+		_ = c.WritePacket(data)
+	}
+	return nil
+}
+
+func (l *latestConn) WritePacketFrom(data []byte) error {
+	if c, _ := l.current(); c != nil {
+		_ = c.WritePacketFrom(data)
+	}
+	return nil
+}
+
+func (l *latestConn) WritePackets(packets [][]byte) error {
+	if c, _ := l.current(); c != nil {
+		_ = c.WritePackets(packets)
+	}
+	return nil
+}
+
+// WaitPathMTU waits for the first session to announce its path mtu
+func (l *latestConn) WaitPathMTU(ctx context.Context) int {
+	for {
+		c, changed := l.current()
+		if c != nil {
+			return c.WaitPathMTU(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-l.done:
+			return 0
+		case <-changed:
+		}
+	}
+}
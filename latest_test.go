@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"github.com/BaiMeow/aict/client"
+	"github.com/BaiMeow/aict/server"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+// readLatest reads a packet of l, it fails the test after timeout
+func readLatest(t *testing.T, l *latestConn, timeout time.Duration) string {
+	t.Helper()
+	ch := make(chan []byte, 1)
+	go func() {
+		data, err := l.ReadPacket()
+		if err == nil {
+			ch <- data
+		}
+	}()
+	select {
+	case data := <-ch:
+		return string(data)
+	case <-time.After(timeout):
+		t.Fatal("no packet read")
+		return ""
+	}
+}
+
+func TestLatestConnTakeover(t *testing.T) {
+	loopback := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	listener, err := server.Listen(loopback, &net.IPAddr{IP: net.IPv4zero}, &server.Config{IdleTimeout: -1})
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	defer listener.Close()
+	l := newLatestConn(listener, slog.Default())
+
+	dial := func(id int, data string) *client.AictConn {
+		c, err := client.Dial(&net.IPAddr{IP: net.IPv4zero}, loopback, &client.Config{Identify: id, PingInterval: -1, Reconnect: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = c.Close() })
+		if err := c.WritePacket([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	first := dial(4001, "first")
+	if got := readLatest(t, l, 5*time.Second); got != "first" {
+		t.Fatalf("read %q", got)
+	}
+	dial(4002, "second")
+	if got := readLatest(t, l, 5*time.Second); got != "second" {
+		t.Fatalf("read %q", got)
+	}
+
+	// the replaced client exits instead of redialing
+	if err := first.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.ReadPacket(); !errors.Is(err, client.ErrTakenOver) {
+		t.Fatalf("expect taken over, got %v", err)
+	}
+	if sessions := listener.Sessions(); len(sessions) != 1 || sessions[0].ID() != 4002 {
+		t.Fatalf("sessions %v after takeover", sessions)
+	}
+}
@@ -1,109 +1,297 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/BaiMeow/aict/aict"
 	"github.com/BaiMeow/aict/client"
 	"github.com/BaiMeow/aict/server"
 	"log"
+	"log/slog"
 	"net"
+	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
-type Conn interface {
-	ReadPacket() ([]byte, error)
-	WritePacket([]byte) error
-}
-
-var (
-	seqQueueSize int
-	clientMode   bool
-	serverMode   bool
-	local        string
-	remote       string
-	pipe         string
-	MTU          int
-	address      string
-	routes       string
-)
+// Conn is the packet conn pipes run on
+type Conn = aict.Conn
 
 func main() {
+	var (
+		configPath  string
+		metricsAddr string
+		logLevel    string
+		clientMode  bool
+		serverMode  bool
+		routes      string
+	)
+	t := defaultTunnel()
+	flag.StringVar(&configPath, "config", "", "run the tunnels of the json config file, other flags are ignored")
+	flag.StringVar(&metricsAddr, "metrics", "", "serve prometheus metrics on http://addr/metrics, example (127.0.0.1:9100)")
+	flag.StringVar(&logLevel, "log-level", "info", "debug, info, warn or error, debug traces every echo")
 	flag.BoolVar(&clientMode, "c", false, "run as client")
 	flag.BoolVar(&serverMode, "s", false, "run as server")
-	flag.StringVar(&local, "l", "0.0.0.0", "listen addr")
-	flag.StringVar(&remote, "r", "0.0.0.0", "remote addr")
-	flag.IntVar(&seqQueueSize, "seqQueueSize", 10, "[server mode] size of sequence queue")
-	flag.StringVar(&pipe, "p", "tun", "pipe packet, example (udp:12345,tun:tun0)")
-	flag.IntVar(&MTU, "mtu", 1280, "[tun] mtu of tun device")
-	flag.StringVar(&address, "addr", "", "[tun] interface address must be in CIDR format")
+	flag.StringVar(&t.Local, "l", "0.0.0.0", "listen addr, icmpv6 is used in server mode if it is ipv6")
+	flag.StringVar(&t.Remote, "r", t.Remote, "remote addr, icmpv6 is used in client mode if it is ipv6")
+	flag.IntVar(&t.SeqQueueSize, "seqQueueSize", t.SeqQueueSize, "[server mode] size of sequence queue")
+	flag.IntVar(&t.MaxSessions, "maxSessions", t.MaxSessions, "[server mode] max clients served at once")
+	flag.StringVar(&t.Pipe, "p", t.Pipe, "pipe packet, example (udp:12345,udp:12345=127.0.0.1:51820,tun:tun0,stdio,tcp:127.0.0.1:22,socks5:1080,forward:127.0.0.1:2222=10.0.0.5:22,reverse:0.0.0.0:2222=127.0.0.1:22,proxy)")
+	flag.IntVar(&t.MTU, "mtu", t.MTU, "[tun] mtu of tun device, 0 to use path mtu of icmp echo")
+	flag.StringVar(&t.Address, "addr", "", "[tun] interface address must be in CIDR format")
 	flag.StringVar(&routes, "routes", "", "[tun] routes,example (1.1.1.1/32,2.2.2.0/30)")
+	flag.StringVar(&t.PSK, "psk", "", "pre-shared key, encrypt and authenticate packets if set")
+	flag.BoolVar(&t.Unprivileged, "unprivileged", false, "[client mode] use unprivileged icmp datagram socket, see net.ipv4.ping_group_range")
+	flag.IntVar(&t.EchoSize, "echoSize", t.EchoSize, "max size of icmp echo data, larger packets are fragmented")
+	flag.BoolVar(&t.PathMTUDiscovery, "pmtud", false, "[client mode] discover the largest icmp echo size up to echoSize")
+	flag.DurationVar((*time.Duration)(&t.SeqTTL), "seqTTL", time.Duration(t.SeqTTL), "[server mode] discard id/seq pairs older than it, negative never expires")
+	flag.DurationVar((*time.Duration)(&t.DeadTimeout), "deadTimeout", time.Duration(t.DeadTimeout), "[client mode] redial with a new id if no reply in it, negative disables")
+	flag.BoolVar(&t.Compress, "compress", false, "deflate packets that shrink, used if both sides enable it")
+	flag.DurationVar((*time.Duration)(&t.IdleTimeout), "idleTimeout", time.Duration(t.IdleTimeout), "[server mode] end sessions without echoes in it, negative never ends")
+	flag.IntVar(&t.MinAirSeqCount, "minAirSeqCount", t.MinAirSeqCount, "[client mode] min echo requests kept on server for replies")
+	flag.IntVar(&t.MaxAirSeqCount, "maxAirSeqCount", t.MaxAirSeqCount, "[client mode] max echo requests kept on server for replies")
 	flag.Parse()
 
-	localAddr := net.ParseIP(local)
-	if localAddr == nil {
-		log.Fatalln("invalid local addr")
+	if configPath != "" {
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			log.Fatalf("config: %v", err)
+		}
+		setupLog(cfg.LogLevel)
+		if cfg.Metrics != "" {
+			// the tunnels run without metrics
+			if err := serveMetrics(cfg.Metrics); err != nil {
+				slog.Error("serve metrics", "err", err)
+			}
+		}
+		var wg sync.WaitGroup
+		for _, t := range cfg.Tunnels {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// a failed tunnel doesn't stop the others
+				if err := t.run(); err != nil {
+					slog.Error("tunnel exits", "tunnel", t.Name, "err", err)
+				}
+			}()
+		}
+		wg.Wait()
+		return
+	}
+
+	level, err := parseLevel(logLevel)
+	if err != nil {
+		log.Fatalf("log level: %v", err)
+	}
+	setupLog(level)
+	if clientMode && !serverMode {
+		t.Role = roleClient
+	} else if serverMode && !clientMode {
+		t.Role = roleServer
+	} else {
+		log.Fatalln("args conflict, unknown running mode")
+	}
+	if !flagPassed("l") {
+		t.Local = ""
+	}
+	if routes != "" {
+		t.Routes = strings.Split(routes, ",")
+	}
+	if metricsAddr != "" {
+		if err := serveMetrics(metricsAddr); err != nil {
+			slog.Error("serve metrics", "err", err)
+		}
+	}
+	if err := t.run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run starts the client or server of the tunnel and runs its pipe,
+// it returns when the pipe ends and closes the client or server then
+func (t *Tunnel) run() error {
+	logger := slog.Default()
+	if t.Name != "" {
+		logger = logger.With("tunnel", t.Name)
+		logger.Info("start", "role", t.Role, "remote", t.Remote, "pipe", t.Pipe)
 	}
-	remoteAddr := net.ParseIP(remote)
+	remoteAddr := net.ParseIP(t.Remote)
 	if remoteAddr == nil {
-		log.Fatalln("invalid remote addr")
+		return errors.New("invalid remote addr")
+	}
+	localAddr := net.IPv4zero
+	if t.Local != "" {
+		localAddr = net.ParseIP(t.Local)
+		if localAddr == nil {
+			return errors.New("invalid local addr")
+		}
+	} else if t.Role == roleClient && remoteAddr.To4() == nil {
+		// listen on the family of remote
+		localAddr = net.IPv6unspecified
 	}
 
 	var (
-		conn Conn
-		err  error
+		conn     Conn
+		listener *server.Listener
+		err      error
 	)
-	if !clientMode && serverMode {
-		conn, err = server.Listen(&net.IPAddr{IP: localAddr}, &net.IPAddr{IP: remoteAddr}, &server.Config{SeqQueueSize: seqQueueSize})
+	isClient := t.Role == roleClient
+	if isClient {
+		var c *client.AictConn
+		c, err = client.Dial(&net.IPAddr{IP: localAddr}, &net.IPAddr{IP: remoteAddr}, &client.Config{
+			PSK:              []byte(t.PSK),
+			Unprivileged:     t.Unprivileged,
+			EchoSize:         t.EchoSize,
+			PathMTUDiscovery: t.PathMTUDiscovery,
+			DeadTimeout:      time.Duration(t.DeadTimeout),
+			Reconnect:        true,
+			Compression:      t.Compress,
+			MinAirSeqCount:   t.MinAirSeqCount,
+			MaxAirSeqCount:   t.MaxAirSeqCount,
+			Logger:           logger,
+		})
 		if err != nil {
-			log.Fatalf("server: %v", err)
+			return fmt.Errorf("client: %v", err)
 		}
-	} else if clientMode && !serverMode {
-		conn, err = client.Dial(&net.IPAddr{IP: localAddr}, &net.IPAddr{IP: remoteAddr}, &client.Config{})
+		defer func() { _ = c.Close() }()
+		t.watchClient(c)
+		conn = c
+	} else {
+		listener, err = server.Listen(&net.IPAddr{IP: localAddr}, &net.IPAddr{IP: remoteAddr}, &server.Config{
+			SeqQueueSize: t.SeqQueueSize,
+			MaxSessions:  t.MaxSessions,
+			SeqTTL:       time.Duration(t.SeqTTL),
+			PSK:          []byte(t.PSK),
+			EchoSize:     t.EchoSize,
+			IdleTimeout:  time.Duration(t.IdleTimeout),
+			Compression:  t.Compress,
+			Logger:       logger,
+		})
 		if err != nil {
-			log.Fatalf("client: %v", err)
+			return fmt.Errorf("server: %v", err)
 		}
-	} else {
-		log.Fatalln("args conflict, unknown running mode")
+		defer func() { _ = listener.Close() }()
+		t.watchListener(listener)
 	}
 
-	arr := strings.SplitN(strings.TrimSpace(pipe), ":", 2)
+	arr := strings.SplitN(strings.TrimSpace(t.Pipe), ":", 2)
 	var pipeProto string
 	var pipeArg string
 	if len(arr) < 1 {
-		log.Fatalln("parse arg pipe failed")
+		return errors.New("parse arg pipe failed")
 	}
 	pipeProto = arr[0]
 	if len(arr) == 2 {
 		pipeArg = arr[1]
 	}
 
+	if listener != nil {
+		switch pipeProto {
+		case "tcp":
+			// serve every client
+			for {
+				c, err := listener.Accept()
+				if err != nil {
+					return fmt.Errorf("server: accept: %v", err)
+				}
+				go tcpUp(c, sessionLogger(logger, c), pipeArg)
+			}
+		case "proxy", "socks5", "forward", "reverse":
+			// serve the requests of every client the pipe allows
+			policy, err := serverPolicy(pipeProto, pipeArg)
+			if err != nil {
+				return fmt.Errorf("server: %v", err)
+			}
+			for {
+				c, err := listener.Accept()
+				if err != nil {
+					return fmt.Errorf("server: accept: %v", err)
+				}
+				go proxyUp(c, sessionLogger(logger, c), isClient, policy)
+			}
+		}
+		// other pipes serve a single peer, the latest client takes over
+		conn = newLatestConn(listener, logger)
+	}
+
 	switch pipeProto {
 	case "tun":
-		tunUp(conn, pipeArg)
+		return tunUp(conn, logger, pipeArg, t.MTU, t.Address, t.Routes)
 	case "udp":
-		panic("not implemented")
+		return udpUp(conn, logger, pipeArg)
+	case "stdio":
+		return stdioUp(conn, logger)
+	case "tcp":
+		tcpUp(conn, logger, pipeArg)
+		return nil
+	case "socks5":
+		return socksUp(conn, logger, pipeArg, isClient)
+	case "forward":
+		return forwardUp(conn, logger, pipeArg, isClient)
+	case "reverse":
+		return reverseUp(conn, logger, pipeArg, isClient)
+	case "proxy":
+		proxyUp(conn, logger, isClient, openProxy)
+		return nil
 	case "test":
-		test(conn)
+		return test(conn, logger)
 	default:
-		log.Fatalf("unknown pipe proto: %s", pipeProto)
+		return fmt.Errorf("unknown pipe proto: %s", pipeProto)
 	}
 }
 
-func test(conn Conn) {
+// sessionLogger tags logger with the client of session c
+func sessionLogger(logger *slog.Logger, c *server.AictConn) *slog.Logger {
+	return logger.With("peer", c.RemoteAddr().String(), "id", c.ID())
+}
+
+// setupLog logs in text to stderr from level on, the log package included
+func setupLog(level slog.Level) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+}
+
+func flagPassed(name string) bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
+// statsConn reports rtt and loss measured by pings
+type statsConn interface {
+	Stats() client.Stats
+}
+
+func test(conn Conn, logger *slog.Logger) error {
+	errc := make(chan error, 1)
 	go func() {
 		for {
 			data, err := conn.ReadPacket()
 			if err != nil {
-				log.Fatalln(err)
+				errc <- err
+				return
 			}
 			fmt.Println(string(data))
 		}
 	}()
 	for {
+		select {
+		case err := <-errc:
+			return err
+		default:
+		}
 		err := conn.WritePacket([]byte("bbb"))
 		if err != nil {
-			log.Fatalln(err)
+			return err
+		}
+		if sc, ok := conn.(statsConn); ok {
+			s := sc.Stats()
+			logger.Info("stats", "rtt", s.RTT, "rttvar", s.RTTVar, "loss", s.Loss, "lost", s.Lost, "sent", s.Sent)
 		}
 		time.Sleep(time.Second)
 	}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"github.com/BaiMeow/aict/client"
+	"github.com/BaiMeow/aict/metrics"
+	"github.com/BaiMeow/aict/server"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// registry collects the metrics of running tunnels for /metrics
+var registry collector
+
+type collector struct {
+	lock    sync.Mutex
+	sources []func() []metrics.Series
+}
+
+func (c *collector) add(source func() []metrics.Series) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sources = append(c.sources, source)
+}
+
+func (c *collector) collect() []metrics.Series {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var series []metrics.Series
+	for _, source := range c.sources {
+		series = append(series, source()...)
+	}
+	return series
+}
+
+// serveMetrics serves /metrics in the prometheus text format on addr.
+// It fails only if addr can't be bound, later errors are logged.
+func serveMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("metrics: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(registry.collect))
+	go func() {
+		slog.Error("metrics: serve", "err", http.Serve(ln, mux))
+	}()
+	slog.Info("metrics: serve", "url", "http://"+ln.Addr().String()+"/metrics")
+	return nil
+}
+
+// labels tell the series of the tunnel apart
+func (t *Tunnel) labels(peer string) []metrics.Label {
+	return []metrics.Label{{Name: "tunnel", Value: t.Name}, {Name: "role", Value: t.Role}, {Name: "peer", Value: peer}}
+}
+
+// watchClient adds the client of the tunnel to registry
+func (t *Tunnel) watchClient(c *client.AictConn) {
+	registry.add(func() []metrics.Series {
+		return []metrics.Series{{Labels: t.labels(t.Remote), Snapshot: c.Metrics()}}
+	})
+}
+
+// watchListener adds the listener and its sessions to registry,
+// echoes before a session is found are in the series without peer
+func (t *Tunnel) watchListener(l *server.Listener) {
+	registry.add(func() []metrics.Series {
+		series := []metrics.Series{{Labels: t.labels(""), Snapshot: l.Metrics()}}
+		for _, c := range l.Sessions() {
+			labels := append(t.labels(c.RemoteAddr().String()), metrics.Label{Name: "id", Value: strconv.Itoa(int(c.ID()))})
+			series = append(series, metrics.Series{Labels: labels, Snapshot: c.Metrics()})
+		}
+		return series
+	})
+}
@@ -0,0 +1,162 @@
+// Package metrics counts echoes of conns and exposes them
+// in the prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Metrics are the counters of a conn, safe for concurrent use.
+// Echoes are counted once encoded to send and once decoded on receive.
+type Metrics struct {
+	EchoesSent         atomic.Uint64
+	EchoesReceived     atomic.Uint64
+	KeepalivesSent     atomic.Uint64
+	KeepalivesReceived atomic.Uint64
+	// BytesSent and BytesReceived count echo data, icmp and ip headers excluded
+	BytesSent     atomic.Uint64
+	BytesReceived atomic.Uint64
+	// EmptyPops counts packets waiting for an id/seq pair on an empty queue
+	EmptyPops atomic.Uint64
+	// ParseErrors counts echoes failing to parse, decrypt or decode
+	ParseErrors atomic.Uint64
+	// Drops counts packets dropped on a full read buffer
+	Drops atomic.Uint64
+}
+
+// Sent counts an echo of data bytes sent
+func (m *Metrics) Sent(data int, keepalive bool) {
+	m.EchoesSent.Add(1)
+	m.BytesSent.Add(uint64(data))
+	if keepalive {
+		m.KeepalivesSent.Add(1)
+	}
+}
+
+// Received counts an echo of data bytes received
+func (m *Metrics) Received(data int, keepalive bool) {
+	m.EchoesReceived.Add(1)
+	m.BytesReceived.Add(uint64(data))
+	if keepalive {
+		m.KeepalivesReceived.Add(1)
+	}
+}
+
+// Snapshot returns the counters, gauges are left for the conn to fill
+func (m *Metrics) Snapshot() Snapshot {
+	return Snapshot{
+		EchoesSent:         m.EchoesSent.Load(),
+		EchoesReceived:     m.EchoesReceived.Load(),
+		KeepalivesSent:     m.KeepalivesSent.Load(),
+		KeepalivesReceived: m.KeepalivesReceived.Load(),
+		BytesSent:          m.BytesSent.Load(),
+		BytesReceived:      m.BytesReceived.Load(),
+		EmptyPops:          m.EmptyPops.Load(),
+		ParseErrors:        m.ParseErrors.Load(),
+		Drops:              m.Drops.Load(),
+	}
+}
+
+// Snapshot is the counters and gauges of a conn at some time
+type Snapshot struct {
+	EchoesSent         uint64
+	EchoesReceived     uint64
+	KeepalivesSent     uint64
+	KeepalivesReceived uint64
+	BytesSent          uint64
+	BytesReceived      uint64
+	EmptyPops          uint64
+	ParseErrors        uint64
+	Drops              uint64
+	// SeqDropped counts id/seq pairs expired or pushed out of the server queue
+	SeqDropped uint64
+
+	// SeqQueueDepth is the fresh id/seq pairs in the server queue,
+	// as told by the last credit on client
+	SeqQueueDepth int
+	// AirSeqCount is the echo requests the client keeps on server
+	AirSeqCount int
+	// ReadQueue and WriteQueue are the packets waiting in the buffers
+	ReadQueue  int
+	WriteQueue int
+}
+
+// Label tells series of the same metric apart
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Series is a snapshot with its labels, like the tunnel and the peer
+type Series struct {
+	Labels   []Label
+	Snapshot Snapshot
+}
+
+type family struct {
+	name  string
+	typ   string
+	help  string
+	value func(s *Snapshot) uint64
+}
+
+var families = []family{
+	{"aict_echoes_sent_total", "counter", "Echoes sent, keepalives included.", func(s *Snapshot) uint64 { return s.EchoesSent }},
+	{"aict_echoes_received_total", "counter", "Echoes received, keepalives included.", func(s *Snapshot) uint64 { return s.EchoesReceived }},
+	{"aict_keepalives_sent_total", "counter", "Keepalive echoes sent.", func(s *Snapshot) uint64 { return s.KeepalivesSent }},
+	{"aict_keepalives_received_total", "counter", "Keepalive echoes received.", func(s *Snapshot) uint64 { return s.KeepalivesReceived }},
+	{"aict_sent_bytes_total", "counter", "Echo data bytes sent.", func(s *Snapshot) uint64 { return s.BytesSent }},
+	{"aict_received_bytes_total", "counter", "Echo data bytes received.", func(s *Snapshot) uint64 { return s.BytesReceived }},
+	{"aict_seq_queue_empty_pops_total", "counter", "Packets waiting for an id/seq pair on an empty queue.", func(s *Snapshot) uint64 { return s.EmptyPops }},
+	{"aict_seq_dropped_total", "counter", "Id/seq pairs expired or pushed out of a full queue.", func(s *Snapshot) uint64 { return s.SeqDropped }},
+	{"aict_parse_errors_total", "counter", "Echoes failing to parse, decrypt or decode.", func(s *Snapshot) uint64 { return s.ParseErrors }},
+	{"aict_read_drops_total", "counter", "Packets dropped on a full read buffer.", func(s *Snapshot) uint64 { return s.Drops }},
+	{"aict_seq_queue_depth", "gauge", "Fresh id/seq pairs in the server queue.", func(s *Snapshot) uint64 { return uint64(s.SeqQueueDepth) }},
+	{"aict_air_seq_count", "gauge", "Echo requests the client keeps on server.", func(s *Snapshot) uint64 { return uint64(s.AirSeqCount) }},
+	{"aict_read_queue_packets", "gauge", "Packets waiting in the read buffer.", func(s *Snapshot) uint64 { return uint64(s.ReadQueue) }},
+	{"aict_write_queue_packets", "gauge", "Packets waiting in the write buffer.", func(s *Snapshot) uint64 { return uint64(s.WriteQueue) }},
+}
+
+// WriteText writes series in the prometheus text format
+func WriteText(w io.Writer, series []Series) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for i := range series {
+			bw.WriteString(f.name)
+			writeLabels(bw, series[i].Labels)
+			fmt.Fprintf(bw, " %d\n", f.value(&series[i].Snapshot))
+		}
+	}
+	return bw.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeLabels(w *bufio.Writer, labels []Label) {
+	if len(labels) == 0 {
+		return
+	}
+	w.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		fmt.Fprintf(w, `%s="%s"`, l.Name, labelEscaper.Replace(l.Value))
+	}
+	w.WriteByte('}')
+}
+
+// Handler serves the series returned by collect on every scrape
+func Handler(collect func() []Series) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		// an error means the scraper is gone, nothing to tell
+		_ = WriteText(w, collect())
+	})
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	var m Metrics
+	m.Sent(100, false)
+	m.Sent(20, true)
+	m.Received(50, true)
+	s := m.Snapshot()
+	s.SeqQueueDepth = 3
+
+	var buf bytes.Buffer
+	err := WriteText(&buf, []Series{
+		{Labels: []Label{{"tunnel", "wg"}, {"peer", `a"b`}}, Snapshot: s},
+		{Snapshot: Snapshot{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE aict_echoes_sent_total counter",
+		`aict_echoes_sent_total{tunnel="wg",peer="a\"b"} 2`,
+		`aict_keepalives_sent_total{tunnel="wg",peer="a\"b"} 1`,
+		`aict_sent_bytes_total{tunnel="wg",peer="a\"b"} 120`,
+		`aict_received_bytes_total{tunnel="wg",peer="a\"b"} 50`,
+		"# TYPE aict_seq_queue_depth gauge",
+		`aict_seq_queue_depth{tunnel="wg",peer="a\"b"} 3`,
+		"aict_seq_queue_depth 0",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("missing %q in\n%s", line, out)
+		}
+	}
+}
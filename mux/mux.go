@@ -0,0 +1,284 @@
+package mux
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BaiMeow/aict/stream"
+	"gvisor.dev/gvisor/pkg/binary"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	headerLen      = 4
+	acceptQueueLen = 64
+	streamQueueLen = 256
+)
+
+var ErrClosed = errors.New("mux: session closed")
+
+// Session multiplexes streams over one PacketConn, every packet is
+// prefixed with the stream id. Each side allocates increasing ids of its own
+// parity, a packet with an unknown id newer than the last accepted one opens
+// a stream on the peer.
+type Session struct {
+	conn stream.PacketConn
+	cfg  *stream.Config
+	log  *slog.Logger
+
+	lock         sync.Mutex
+	streams      map[uint32]*packetConn
+	nextID       uint32
+	lastAccepted uint32
+
+	accept    chan *stream.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// New starts a session over conn, the two sides must have different initiator values.
+// cfg is used for every stream and may be nil, the session logs to its Logger as well.
+func New(conn stream.PacketConn, initiator bool, cfg *stream.Config) *Session {
+	s := &Session{
+		conn:    conn,
+		cfg:     cfg,
+		log:     slog.Default(),
+		streams: make(map[uint32]*packetConn),
+		accept:  make(chan *stream.Conn, acceptQueueLen),
+		done:    make(chan struct{}),
+	}
+	if cfg != nil && cfg.Logger != nil {
+		s.log = cfg.Logger
+	}
+	// initiator uses odd ids
+	if initiator {
+		s.nextID = 1
+	} else {
+		s.nextID = 2
+	}
+	if k, ok := conn.(stream.KeepaliveCarrier); ok {
+		k.SetKeepalivePayload(s.keepalivePayload)
+	}
+	go s.readRoutine()
+	return s
+}
+
+// Open starts a new stream, the peer gets it from Accept once data arrives
+func (s *Session) Open() (*stream.Conn, error) {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	pc := s.newPacketConn(id)
+	s.lock.Unlock()
+	return stream.New(pc, s.streamConfig()), nil
+}
+
+func (s *Session) Accept() (*stream.Conn, error) {
+	select {
+	case <-s.done:
+		return nil, s.err
+	case c := <-s.accept:
+		return c, nil
+	}
+}
+
+// Close closes all streams and the underlying conn if it is closable
+func (s *Session) Close() error {
+	s.close(ErrClosed)
+	return nil
+}
+
+func (s *Session) close(err error) {
+	s.closeOnce.Do(func() {
+		s.lock.Lock()
+		s.err = err
+		streams := s.streams
+		s.streams = make(map[uint32]*packetConn)
+		s.lock.Unlock()
+		close(s.done)
+		for _, pc := range streams {
+			pc.closeRead()
+		}
+		if closer, ok := s.conn.(interface{ Close() error }); ok {
+			_ = closer.Close()
+		}
+	})
+}
+
+func (s *Session) streamConfig() *stream.Config {
+	if s.cfg == nil {
+		return nil
+	}
+	cfg := *s.cfg
+	return &cfg
+}
+
+// newPacketConn must hold lock
+func (s *Session) newPacketConn(id uint32) *packetConn {
+	pc := &packetConn{
+		s:      s,
+		id:     id,
+		in:     make(chan []byte, streamQueueLen),
+		closed: make(chan struct{}),
+	}
+	s.streams[id] = pc
+	return pc
+}
+
+func (s *Session) readRoutine() {
+	for {
+		data, err := s.conn.ReadPacket()
+		if err != nil {
+			s.close(err)
+			return
+		}
+		if len(data) < headerLen {
+			s.log.Warn("short mux packet", "len", len(data))
+			continue
+		}
+		id := binary.LittleEndian.Uint32(data[:headerLen])
+
+		s.lock.Lock()
+		pc, ok := s.streams[id]
+		var accepted *stream.Conn
+		// peer ids have the other parity
+		if !ok && id%2 != s.nextID%2 && id > s.lastAccepted {
+			s.lastAccepted = id
+			pc = s.newPacketConn(id)
+			accepted = stream.New(pc, s.streamConfig())
+		}
+		s.lock.Unlock()
+		if pc == nil {
+			// stream already closed
+			continue
+		}
+		if accepted != nil {
+			select {
+			case s.accept <- accepted:
+			default:
+				s.log.Warn("accept queue full, drop stream", "stream", id)
+				_ = accepted.Close()
+				continue
+			}
+		}
+		pc.push(data[headerLen:])
+	}
+}
+
+// keepalivePayload lets one stream with pending ack ride on the keepalive
+func (s *Session) keepalivePayload() []byte {
+	s.lock.Lock()
+	streams := make([]*packetConn, 0, len(s.streams))
+	for _, pc := range s.streams {
+		streams = append(streams, pc)
+	}
+	s.lock.Unlock()
+	for _, pc := range streams {
+		if p := pc.keepalivePayload(); p != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *Session) remove(pc *packetConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.streams[pc.id] == pc {
+		delete(s.streams, pc.id)
+	}
+}
+
+// packetConn is the PacketConn of a single stream in session
+type packetConn struct {
+	s    *Session
+	id   uint32
+	in   chan []byte
+	keep atomic.Pointer[func() []byte]
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (pc *packetConn) push(data []byte) {
+	select {
+	case <-pc.closed:
+	case pc.in <- data:
+	default:
+		// stream is too slow, the segment will be retransmitted
+	}
+}
+
+func (pc *packetConn) ReadPacket() ([]byte, error) {
+	select {
+	case <-pc.closed:
+		return nil, net.ErrClosed
+	case data := <-pc.in:
+		return data, nil
+	}
+}
+
+func (pc *packetConn) WritePacket(data []byte) error {
+	select {
+	case <-pc.closed:
+		return net.ErrClosed
+	default:
+	}
+	buf := make([]byte, headerLen+len(data))
+	binary.LittleEndian.PutUint32(buf[:headerLen], pc.id)
+	copy(buf[headerLen:], data)
+	return pc.s.conn.WritePacket(buf)
+}
+
+func (pc *packetConn) SetKeepalivePayload(f func() []byte) {
+	pc.keep.Store(&f)
+}
+
+func (pc *packetConn) keepalivePayload() []byte {
+	f := pc.keep.Load()
+	if f == nil {
+		return nil
+	}
+	p := (*f)()
+	if p == nil {
+		return nil
+	}
+	buf := make([]byte, headerLen+len(p))
+	binary.LittleEndian.PutUint32(buf[:headerLen], pc.id)
+	copy(buf[headerLen:], p)
+	return buf
+}
+
+type addr uint32
+
+func (addr) Network() string  { return "aict-mux" }
+func (a addr) String() string { return fmt.Sprintf("stream-%d", uint32(a)) }
+
+func (pc *packetConn) LocalAddr() net.Addr {
+	return addr(pc.id)
+}
+
+func (pc *packetConn) RemoteAddr() net.Addr {
+	if a, ok := pc.s.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return a.RemoteAddr()
+	}
+	return addr(pc.id)
+}
+
+func (pc *packetConn) closeRead() {
+	pc.closeOnce.Do(func() { close(pc.closed) })
+}
+
+// Close is called by the stream when it is finished
+func (pc *packetConn) Close() error {
+	pc.closeRead()
+	pc.s.remove(pc)
+	return nil
+}
@@ -0,0 +1,96 @@
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+type pipeConn struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func pipe() (*pipeConn, *pipeConn) {
+	a2b, b2a := make(chan []byte, 1024), make(chan []byte, 1024)
+	return &pipeConn{in: b2a, out: a2b, closed: make(chan struct{})},
+		&pipeConn{in: a2b, out: b2a, closed: make(chan struct{})}
+}
+
+func (c *pipeConn) ReadPacket() ([]byte, error) {
+	select {
+	case <-c.closed:
+		return nil, net.ErrClosed
+	case p := <-c.in:
+		return p, nil
+	}
+}
+
+func (c *pipeConn) WritePacket(p []byte) error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	case c.out <- append([]byte(nil), p...):
+		return nil
+	}
+}
+
+func (c *pipeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestSession(t *testing.T) {
+	a, b := pipe()
+	client, server := New(a, true, nil), New(b, false, nil)
+	defer client.Close()
+	defer server.Close()
+
+	// echo server
+	go func() {
+		for {
+			c, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(c, c)
+				_ = c.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			msg := bytes.Repeat([]byte(fmt.Sprintf("stream %d ", i)), 500)
+			if _, err := c.Write(msg); err != nil {
+				t.Error(err)
+				return
+			}
+			_ = c.CloseWrite()
+			got, err := io.ReadAll(c)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, msg) {
+				t.Errorf("stream %d: data mismatch", i)
+			}
+			_ = c.Close()
+		}()
+	}
+	wg.Wait()
+}
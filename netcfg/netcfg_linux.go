@@ -42,3 +42,15 @@ func ApplyNet(iface string, ip *net.IPNet, routes []*net.IPNet) error {
 	}
 	return nil
 }
+
+// SetMTU sets the mtu of iface
+func SetMTU(iface string, mtu int) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("set link mtu: %v", err)
+	}
+	return nil
+}
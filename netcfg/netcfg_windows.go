@@ -28,3 +28,18 @@ func ApplyNet(iface string, ip *net.IPNet, routes []*net.IPNet) error {
 	}
 	return nil
 }
+
+// SetMTU sets the mtu of iface
+func SetMTU(iface string, mtu int) error {
+	systemDir, err := windows.GetSystemDirectory()
+	if err != nil {
+		return fmt.Errorf("get system directory: %v", err)
+	}
+	netsh := filepath.Join(systemDir, "netsh.exe")
+
+	if output, err := exec.Command(netsh, "interface", "ipv4", "set", "subinterface", iface, fmt.Sprintf("mtu=%d", mtu), "store=active").CombinedOutput(); err != nil {
+		log.Printf("exec err: %s", output)
+		return fmt.Errorf("set mtu: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package proto
+
+import (
+	"net"
+)
+
+// BatchSize is the max messages of BatchConn.ReadBatch and WriteBatch in one syscall
+const BatchSize = 16
+
+// Message is an icmp message of BatchConn. ReadBatch reads into Buf
+// and reslices it to the message, without ip header.
+type Message struct {
+	Buf  []byte
+	Addr net.Addr
+}
+
+// BatchConn reads and writes icmp messages of an icmp.PacketConn in batches,
+// with recvmmsg and sendmmsg on linux and one message per syscall elsewhere.
+// It is safe for concurrent use like net.PacketConn.
+type BatchConn struct {
+	net.PacketConn
+	batch batcher
+}
+
+// batcher moves messages of the underlying socket in batches,
+// nil if it is not supported
+type batcher interface {
+	readBatch(ms []Message) (int, error)
+	writeBatch(ms []Message) (int, error)
+}
+
+func NewBatchConn(conn net.PacketConn) *BatchConn {
+	return &BatchConn{PacketConn: conn, batch: newBatcher(conn)}
+}
+
+// ReadBatch reads at least one message into ms, up to BatchSize,
+// and returns the count read
+func (c *BatchConn) ReadBatch(ms []Message) (int, error) {
+	if c.batch != nil {
+		return c.batch.readBatch(ms[:min(len(ms), BatchSize)])
+	}
+	n, addr, err := c.ReadFrom(ms[0].Buf)
+	if err != nil {
+		return 0, err
+	}
+	ms[0].Buf = ms[0].Buf[:n]
+	ms[0].Addr = addr
+	return 1, nil
+}
+
+// WriteBatch writes all messages of ms unless an error happens
+func (c *BatchConn) WriteBatch(ms []Message) error {
+	for len(ms) > 0 {
+		if c.batch == nil {
+			if _, err := c.WriteTo(ms[0].Buf, ms[0].Addr); err != nil {
+				return err
+			}
+			ms = ms[1:]
+			continue
+		}
+		n, err := c.batch.writeBatch(ms[:min(len(ms), BatchSize)])
+		if err != nil {
+			return err
+		}
+		ms = ms[n:]
+	}
+	return nil
+}
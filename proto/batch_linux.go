@@ -0,0 +1,96 @@
+//go:build linux
+
+package proto
+
+import (
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"net"
+	"sync"
+)
+
+// mmsgConn is ipv4.PacketConn or ipv6.PacketConn,
+// both use the same message type
+type mmsgConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// mmsgBatcher batches with recvmmsg and sendmmsg
+type mmsgBatcher struct {
+	conn mmsgConn
+	// header is true for raw ipv4 sockets, which read the ip header
+	header bool
+	// scratch holds *[]ipv4.Message of BatchSize, so batches don't allocate
+	scratch sync.Pool
+}
+
+func newBatcher(conn net.PacketConn) batcher {
+	ic, ok := conn.(*icmp.PacketConn)
+	if !ok {
+		return nil
+	}
+	_, raw := conn.LocalAddr().(*net.IPAddr)
+	b := &mmsgBatcher{}
+	if p := ic.IPv4PacketConn(); p != nil {
+		b.conn = p
+		b.header = raw
+	} else if p := ic.IPv6PacketConn(); p != nil {
+		b.conn = p
+	} else {
+		return nil
+	}
+	b.scratch.New = func() any {
+		ms := make([]ipv4.Message, BatchSize)
+		for i := range ms {
+			ms[i].Buffers = make([][]byte, 1)
+		}
+		return &ms
+	}
+	return b
+}
+
+func (b *mmsgBatcher) readBatch(ms []Message) (int, error) {
+	scratch := b.scratch.Get().(*[]ipv4.Message)
+	defer b.scratch.Put(scratch)
+	mms := (*scratch)[:len(ms)]
+	for i := range ms {
+		mms[i].Buffers[0] = ms[i].Buf
+	}
+	n, err := b.conn.ReadBatch(mms, 0)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		buf := ms[i].Buf[:mms[i].N]
+		if b.header && len(buf) > 0 {
+			// recvmmsg doesn't strip the ip header like net.IPConn
+			hl := int(buf[0]&0x0f) << 2
+			if hl > len(buf) {
+				hl = len(buf)
+			}
+			buf = buf[hl:]
+		}
+		ms[i].Buf = buf
+		ms[i].Addr = mms[i].Addr
+		mms[i].Buffers[0] = nil
+		mms[i].Addr = nil
+	}
+	return n, nil
+}
+
+func (b *mmsgBatcher) writeBatch(ms []Message) (int, error) {
+	scratch := b.scratch.Get().(*[]ipv4.Message)
+	defer b.scratch.Put(scratch)
+	mms := (*scratch)[:len(ms)]
+	for i := range ms {
+		mms[i].Buffers[0] = ms[i].Buf
+		mms[i].Addr = ms[i].Addr
+	}
+	n, err := b.conn.WriteBatch(mms, 0)
+	for i := range mms {
+		mms[i].Buffers[0] = nil
+		mms[i].Addr = nil
+	}
+	return n, err
+}
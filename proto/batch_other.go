@@ -0,0 +1,12 @@
+//go:build !linux
+
+package proto
+
+import (
+	"net"
+)
+
+// newBatcher returns nil, ipv4.PacketConn only batches on linux
+func newBatcher(conn net.PacketConn) batcher {
+	return nil
+}
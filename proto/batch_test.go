@@ -0,0 +1,60 @@
+package proto
+
+import (
+	"bytes"
+	"golang.org/x/net/icmp"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBatchConn(t *testing.T) {
+	conn, err := icmp.ListenPacket(FamilyV4.Network, "127.0.0.1")
+	if err != nil {
+		t.Skipf("raw icmp socket: %v", err)
+	}
+	c := NewBatchConn(conn)
+	defer c.Close()
+
+	// the raw socket reads its own echo requests on loopback
+	dst := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	const id = 0xa1c7
+	ms := make([]Message, 3)
+	for i := range ms {
+		b := make([]byte, EchoHeaderLen+1)
+		b[EchoHeaderLen] = byte(i)
+		FamilyV4.PutEcho(b, FamilyV4.EchoRequestType, id, uint16(i), nil)
+		ms[i] = Message{Buf: b, Addr: dst}
+	}
+	if err := c.WriteBatch(ms); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	got := 0
+	rms := make([]Message, BatchSize)
+	for got < len(ms) {
+		for i := range rms {
+			rms[i].Buf = make([]byte, 1500)
+		}
+		n, err := c.ReadBatch(rms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range rms[:n] {
+			echo, err := ParseEcho(m.Buf)
+			if err != nil || echo.Type != FamilyV4.EchoRequestType || echo.ID != id {
+				continue
+			}
+			if !bytes.Equal(echo.Data, []byte{byte(echo.Seq)}) {
+				t.Fatalf("echo %d data %x", echo.Seq, echo.Data)
+			}
+			if AddrIP(m.Addr).String() != "127.0.0.1" {
+				t.Fatalf("echo from %v", m.Addr)
+			}
+			got++
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package proto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"gvisor.dev/gvisor/pkg/binary"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NonceSize is the size of nonce sent before each sealed layer
+const NonceSize = 12
+
+const replayWindowSize = 64
+
+var (
+	ErrAuth   = errors.New("message authentication failed")
+	ErrReplay = errors.New("replayed message")
+)
+
+// Direction is the way a layer goes, each direction has its own key
+type Direction uint8
+
+const (
+	ClientToServer Direction = 1
+	ServerToClient Direction = 2
+)
+
+// adLen is the associated data of a sealed layer: direction, echo type and echo id
+const adLen = 4
+
+// Cipher seals marshaled layers with AES-256-GCM under keys derived from a
+// pre-shared key, one for each direction, so a layer can't be reflected back
+// to its sender. The direction and the echo type and id are authenticated.
+// The sealed form is nonce || ciphertext || tag.
+type Cipher struct {
+	seal, open       cipher.AEAD
+	sendDir, recvDir Direction
+	// ads holds *[adLen]byte, a slice passed to cipher.AEAD escapes
+	ads sync.Pool
+}
+
+// NewCipher returns the cipher of a side sealing layers in dir,
+// layers of the other direction are opened
+func NewCipher(psk []byte, dir Direction) (*Cipher, error) {
+	if len(psk) == 0 {
+		return nil, errors.New("empty pre-shared key")
+	}
+	recv := ClientToServer
+	if dir == ClientToServer {
+		recv = ServerToClient
+	}
+	c := &Cipher{sendDir: dir, recvDir: recv}
+	c.ads.New = func() any {
+		return new([adLen]byte)
+	}
+	var err error
+	if c.seal, err = newAEAD(psk, dir); err != nil {
+		return nil, err
+	}
+	if c.open, err = newAEAD(psk, recv); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newAEAD derives the key of dir with HKDF-SHA256, which fits in one block
+func newAEAD(psk []byte, dir Direction) (cipher.AEAD, error) {
+	extract := hmac.New(sha256.New, []byte("aict psk v2"))
+	extract.Write(psk)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte{'a', 'i', 'c', 't', ' ', 'd', 'i', 'r', byte(dir), 1})
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Overhead is the bytes added by Seal
+func (c *Cipher) Overhead() int {
+	return NonceSize + c.seal.Overhead()
+}
+
+func (c *Cipher) ad(dir Direction, typ uint8, id uint16) *[adLen]byte {
+	ad := c.ads.Get().(*[adLen]byte)
+	ad[0] = byte(dir)
+	ad[1] = typ
+	binary.BigEndian.PutUint16(ad[2:], id)
+	return ad
+}
+
+// Seal appends the sealed plain to dst, bound to the echo type and id it is sent in.
+// To seal in place, plain is at buf[NonceSize:] and dst is buf[:0].
+func (c *Cipher) Seal(dst []byte, nonce Nonce, plain []byte, typ uint8, id uint16) []byte {
+	var n [NonceSize]byte
+	nonce.put(n[:])
+	dst = append(dst, n[:]...)
+	ad := c.ad(c.sendDir, typ, id)
+	defer c.ads.Put(ad)
+	// the nonce in dst doesn't escape like n
+	return c.seal.Seal(dst, dst[len(dst)-NonceSize:], plain, ad[:])
+}
+
+// Open appends the opened message of the echo type and id to dst,
+// the nonce should be checked by ReplayWindow.
+// To open in place, dst is sealed[NonceSize:NonceSize].
+func (c *Cipher) Open(dst []byte, sealed []byte, typ uint8, id uint16) ([]byte, Nonce, error) {
+	if len(sealed) < c.Overhead() {
+		return nil, Nonce{}, ErrFormat
+	}
+	ad := c.ad(c.recvDir, typ, id)
+	defer c.ads.Put(ad)
+	plain, err := c.open.Open(dst, sealed[:NonceSize], sealed[NonceSize:], ad[:])
+	if err != nil {
+		return nil, Nonce{}, ErrAuth
+	}
+	var nonce Nonce
+	nonce.get(sealed[:NonceSize])
+	return plain, nonce, nil
+}
+
+// Nonce is a random per-sender salt followed by a sequence number.
+type Nonce struct {
+	Salt uint32
+	Seq  uint64
+}
+
+func (n Nonce) put(b []byte) {
+	binary.BigEndian.PutUint32(b[0:4], n.Salt)
+	binary.BigEndian.PutUint64(b[4:12], n.Seq)
+}
+
+func (n *Nonce) get(b []byte) {
+	n.Salt = binary.BigEndian.Uint32(b[0:4])
+	n.Seq = binary.BigEndian.Uint64(b[4:12])
+}
+
+// NonceSource generates nonces for one sender.
+// Seq starts from the current unix time in nanoseconds, so it keeps
+// increasing across restarts and the peer's ReplayWindow stays valid.
+type NonceSource struct {
+	salt uint32
+	seq  atomic.Uint64
+}
+
+func NewNonceSource() *NonceSource {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	s := &NonceSource{salt: binary.BigEndian.Uint32(b[:])}
+	s.seq.Store(uint64(time.Now().UnixNano()))
+	return s
+}
+
+func (s *NonceSource) Next() Nonce {
+	return Nonce{Salt: s.salt, Seq: s.seq.Add(1)}
+}
+
+// ReplayWindow rejects nonces seen before or too old. Not safe for concurrent use.
+type ReplayWindow struct {
+	max    uint64
+	bitmap uint64
+}
+
+// Check reports whether nonce is fresh and marks it as seen
+func (w *ReplayWindow) Check(nonce Nonce) bool {
+	seq := nonce.Seq
+	switch {
+	case seq > w.max:
+		shift := seq - w.max
+		if shift >= replayWindowSize {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.max = seq
+		return true
+	case w.max-seq >= replayWindowSize:
+		return false
+	default:
+		bit := uint64(1) << (w.max - seq)
+		if w.bitmap&bit != 0 {
+			return false
+		}
+		w.bitmap |= bit
+		return true
+	}
+}
+
+// ReplayFilter is a ReplayWindow per sender, told apart by the nonce salt.
+// It outlives sessions, so packets captured from an ended session can't start
+// or feed a new one. Beyond size senders the least recently seen is forgotten.
+// Not safe for concurrent use.
+type ReplayFilter struct {
+	size    int
+	tick    uint64
+	senders map[uint32]*replaySender
+}
+
+type replaySender struct {
+	w ReplayWindow
+	// seen is the tick of the last fresh nonce
+	seen uint64
+}
+
+func NewReplayFilter(size int) *ReplayFilter {
+	return &ReplayFilter{size: size, senders: make(map[uint32]*replaySender)}
+}
+
+// Check reports whether nonce is fresh for its sender and marks it as seen
+func (f *ReplayFilter) Check(nonce Nonce) bool {
+	s, ok := f.senders[nonce.Salt]
+	if !ok {
+		if len(f.senders) >= f.size {
+			f.evict()
+		}
+		s = &replaySender{}
+		f.senders[nonce.Salt] = s
+	}
+	if !s.w.Check(nonce) {
+		return false
+	}
+	f.tick++
+	s.seen = f.tick
+	return true
+}
+
+// evict forgets the least recently seen sender
+func (f *ReplayFilter) evict() {
+	var (
+		oldest uint32
+		seen   uint64 = math.MaxUint64
+	)
+	for salt, s := range f.senders {
+		if s.seen < seen {
+			oldest, seen = salt, s.seen
+		}
+	}
+	delete(f.senders, oldest)
+}
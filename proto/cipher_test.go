@@ -0,0 +1,137 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCipher(t *testing.T) {
+	c, err := NewCipher([]byte("secret"), ClientToServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewCipher([]byte("secret"), ServerToClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := NewNonceSource()
+	nonce := src.Next()
+	sealed := c.Seal(nil, nonce, []byte("hello"), 8, 1234)
+	if len(sealed) != 5+c.Overhead() {
+		t.Fatalf("sealed len %d", len(sealed))
+	}
+
+	plain, got, err := s.Open(nil, sealed, 8, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, []byte("hello")) || got != nonce {
+		t.Fatalf("open: %q %v", plain, got)
+	}
+
+	// reflected to the sender, or moved to another echo
+	if _, _, err := c.Open(nil, sealed, 8, 1234); err != ErrAuth {
+		t.Fatalf("reflected: %v", err)
+	}
+	if _, _, err := s.Open(nil, sealed, 8, 1235); err != ErrAuth {
+		t.Fatalf("other id: %v", err)
+	}
+	if _, _, err := s.Open(nil, sealed, 0, 1234); err != ErrAuth {
+		t.Fatalf("other type: %v", err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, _, err := s.Open(nil, sealed, 8, 1234); err != ErrAuth {
+		t.Fatalf("tampered: %v", err)
+	}
+
+	other, _ := NewCipher([]byte("other"), ServerToClient)
+	if _, _, err := other.Open(nil, c.Seal(nil, src.Next(), []byte("hello"), 8, 1234), 8, 1234); err != ErrAuth {
+		t.Fatalf("wrong key: %v", err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w ReplayWindow
+	for _, seq := range []uint64{100, 102, 101} {
+		if !w.Check(Nonce{Seq: seq}) {
+			t.Fatalf("fresh %d rejected", seq)
+		}
+	}
+	for _, seq := range []uint64{100, 101, 102} {
+		if w.Check(Nonce{Seq: seq}) {
+			t.Fatalf("replay %d accepted", seq)
+		}
+	}
+	if !w.Check(Nonce{Seq: 200}) {
+		t.Fatal("fresh 200 rejected")
+	}
+	if w.Check(Nonce{Seq: 120}) {
+		t.Fatal("too old 120 accepted")
+	}
+	if !w.Check(Nonce{Seq: 199}) {
+		t.Fatal("in window 199 rejected")
+	}
+}
+
+func TestReplayFilter(t *testing.T) {
+	f := NewReplayFilter(2)
+	a, b, c := Nonce{Salt: 1, Seq: 100}, Nonce{Salt: 2, Seq: 100}, Nonce{Salt: 3, Seq: 100}
+	if !f.Check(a) || !f.Check(b) {
+		t.Fatal("fresh senders rejected")
+	}
+	if f.Check(a) || f.Check(b) {
+		t.Fatal("replay accepted")
+	}
+	// a is seen again, so b is forgotten for c
+	if !f.Check(Nonce{Salt: 1, Seq: 101}) || !f.Check(c) {
+		t.Fatal("fresh nonce rejected")
+	}
+	if f.Check(Nonce{Salt: 1, Seq: 101}) || f.Check(c) {
+		t.Fatal("replay accepted after eviction")
+	}
+	if !f.Check(b) {
+		t.Fatal("forgotten sender rejected")
+	}
+}
+
+func TestCipherInPlace(t *testing.T) {
+	c, err := NewCipher([]byte("secret"), ServerToClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewCipher([]byte("secret"), ClientToServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	copy(buf[NonceSize:], "hello")
+	sealed := c.Seal(buf[:0], NewNonceSource().Next(), buf[NonceSize:NonceSize+5], 0, 1)
+	if &sealed[0] != &buf[0] {
+		t.Fatal("sealed out of place")
+	}
+	plain, _, err := s.Open(sealed[NonceSize:NonceSize], sealed, 0, 1)
+	if err != nil || !bytes.Equal(plain, []byte("hello")) {
+		t.Fatalf("open in place: %q %v", plain, err)
+	}
+}
+
+func BenchmarkSeal(b *testing.B) {
+	c, _ := NewCipher([]byte("secret"), ClientToServer)
+	src := NewNonceSource()
+	plain := make([]byte, 1280)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = c.Seal(nil, src.Next(), plain, 8, 1)
+	}
+}
+
+func BenchmarkSealInPlace(b *testing.B) {
+	c, _ := NewCipher([]byte("secret"), ClientToServer)
+	src := NewNonceSource()
+	buf := make([]byte, 2048)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = c.Seal(buf[:0], src.Next(), buf[NonceSize:NonceSize+1280], 8, 1)
+	}
+}
@@ -0,0 +1,106 @@
+package proto
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+// MinCompressLen is the smallest packet worth compressing
+const MinCompressLen = 64
+
+var errNotShrunk = errors.New("not shrunk")
+
+// compressors and decompressors are pooled, since flate state is large
+var (
+	compressors = sync.Pool{New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return &compressor{w: w}
+	}}
+	decompressors sync.Pool
+)
+
+type compressor struct {
+	w   *flate.Writer
+	out fixedBuffer
+}
+
+// fixedBuffer is written up to max bytes
+type fixedBuffer struct {
+	b   []byte
+	max int
+}
+
+func (f *fixedBuffer) Write(p []byte) (int, error) {
+	if len(f.b)+len(p) > f.max {
+		return 0, errNotShrunk
+	}
+	f.b = append(f.b, p...)
+	return len(p), nil
+}
+
+type decompressor struct {
+	r   io.ReadCloser
+	src bytes.Reader
+}
+
+// Compress deflates src into dst[:0] and returns it, ok is false if
+// src is shorter than MinCompressLen or doesn't shrink within cap(dst).
+func Compress(dst, src []byte) (out []byte, ok bool) {
+	if len(src) < MinCompressLen {
+		return nil, false
+	}
+	c := compressors.Get().(*compressor)
+	defer compressors.Put(c)
+	// at least one byte saved
+	c.out.b = dst[:0]
+	c.out.max = min(cap(dst), len(src)-1)
+	c.w.Reset(&c.out)
+	if _, err := c.w.Write(src); err != nil {
+		return nil, false
+	}
+	if err := c.w.Close(); err != nil {
+		return nil, false
+	}
+	out = c.out.b
+	c.out.b = nil
+	return out, true
+}
+
+// Decompress inflates src into dst and returns dst[:n],
+// ErrTooLarge is returned if it doesn't fit in dst.
+func Decompress(dst, src []byte) ([]byte, error) {
+	d, ok := decompressors.Get().(*decompressor)
+	if !ok {
+		d = &decompressor{}
+	}
+	defer decompressors.Put(d)
+	d.src.Reset(src)
+	if d.r == nil {
+		d.r = flate.NewReader(&d.src)
+	} else if err := d.r.(flate.Resetter).Reset(&d.src, nil); err != nil {
+		return nil, err
+	}
+	for n := 0; n < len(dst); {
+		m, err := d.r.Read(dst[n:])
+		n += m
+		if err == io.EOF {
+			return dst[:n], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// dst is full, the packet is larger unless it ends here
+	var one [1]byte
+	m, err := d.r.Read(one[:])
+	if m > 0 {
+		return nil, ErrTooLarge
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	return dst, nil
+}
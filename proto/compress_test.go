@@ -0,0 +1,60 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 20)
+	out, ok := Compress(make([]byte, len(text)), text)
+	if !ok || len(out) >= len(text) {
+		t.Fatalf("text not compressed, ok %v len %d", ok, len(out))
+	}
+	plain, err := Decompress(make([]byte, 65535), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, text) {
+		t.Fatal("decompressed packet mismatch")
+	}
+	if _, err := Decompress(make([]byte, len(text)-1), out); err != ErrTooLarge {
+		t.Fatalf("expect too large, got %v", err)
+	}
+	if _, err := Decompress(make([]byte, 65535), out[:len(out)/2]); err == nil {
+		t.Fatal("truncated packet decompressed")
+	}
+
+	random := make([]byte, 1400)
+	_, _ = rand.Read(random)
+	if _, ok := Compress(make([]byte, len(random)), random); ok {
+		t.Fatal("random packet compressed")
+	}
+	if _, ok := Compress(make([]byte, 16), text[:16]); ok {
+		t.Fatal("short packet compressed")
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 28)
+	dst := make([]byte, len(text))
+	b.SetBytes(int64(len(text)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Compress(dst, text)
+	}
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 28)
+	out, _ := Compress(make([]byte, len(text)), text)
+	dst := make([]byte, 65535)
+	b.SetBytes(int64(len(text)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decompress(dst, out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package proto
+
+import (
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// CreditLen is the size of Credit at the beginning of payload
+const CreditLen = 6
+
+// Credit is sent by server with FlagCredit, so client knows how many
+// keepalives it needs instead of guessing from the replies.
+type Credit struct {
+	// Depth is the count of fresh id/seq pairs left in the server queue
+	Depth uint16
+	// Waiting is the count of packets waiting for id/seq pairs
+	Waiting uint16
+	// Dropped counts pairs discarded unused, stale or pushed out, wrapping at 65536.
+	// Client tells discarded pairs from lost ones with it.
+	Dropped uint16
+}
+
+// Prepend returns payload with credit in front of it
+func (c *Credit) Prepend(payload []byte) []byte {
+	buf := make([]byte, CreditLen+len(payload))
+	c.Put(buf)
+	copy(buf[CreditLen:], payload)
+	return buf
+}
+
+// Put writes credit into b[:CreditLen]
+func (c *Credit) Put(b []byte) {
+	binary.LittleEndian.PutUint16(b[0:2], c.Depth)
+	binary.LittleEndian.PutUint16(b[2:4], c.Waiting)
+	binary.LittleEndian.PutUint16(b[4:6], c.Dropped)
+}
+
+// Cut reads credit from payload and returns the rest
+func (c *Credit) Cut(payload []byte) ([]byte, error) {
+	if len(payload) < CreditLen {
+		return nil, ErrFormat
+	}
+	c.Depth = binary.LittleEndian.Uint16(payload[0:2])
+	c.Waiting = binary.LittleEndian.Uint16(payload[2:4])
+	c.Dropped = binary.LittleEndian.Uint16(payload[4:6])
+	return payload[CreditLen:], nil
+}
@@ -0,0 +1,22 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCredit(t *testing.T) {
+	c := Credit{Depth: 7, Waiting: 300, Dropped: 65535}
+	buf := c.Prepend([]byte("payload"))
+	var got Credit
+	payload, err := got.Cut(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != c || !bytes.Equal(payload, []byte("payload")) {
+		t.Fatalf("got %+v %q", got, payload)
+	}
+	if _, err := got.Cut(buf[:CreditLen-1]); err != ErrFormat {
+		t.Fatalf("short credit: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package proto
+
+import (
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// EchoHeaderLen is the size of icmp echo header before data
+const EchoHeaderLen = 8
+
+// Echo is an icmp echo request or reply. Unlike icmp.Message,
+// it is encoded and parsed in place without allocation.
+type Echo struct {
+	Type uint8
+	ID   uint16
+	Seq  uint16
+	// Data aliases the buffer the echo is parsed from
+	Data []byte
+}
+
+// ParseEcho parses the icmp message b, it fails only if b is too short,
+// check Type before using it as an echo.
+func ParseEcho(b []byte) (Echo, error) {
+	if len(b) < EchoHeaderLen {
+		return Echo{}, ErrFormat
+	}
+	return Echo{
+		Type: b[0],
+		ID:   binary.BigEndian.Uint16(b[4:6]),
+		Seq:  binary.BigEndian.Uint16(b[6:8]),
+		Data: b[EchoHeaderLen:],
+	}, nil
+}
+
+// PutEcho fills the header of the echo message b, whose data is already
+// at b[EchoHeaderLen:]. The ICMPv6 checksum covers psh, see PseudoHeader,
+// it is left to the kernel if psh is nil.
+func (f *Family) PutEcho(b []byte, typ uint8, id, seq uint16, psh []byte) {
+	b[0] = typ
+	b[1] = 0
+	b[2], b[3] = 0, 0
+	binary.BigEndian.PutUint16(b[4:6], id)
+	binary.BigEndian.PutUint16(b[6:8], seq)
+	var s uint32
+	if f == FamilyV6 {
+		if psh == nil {
+			return
+		}
+		// upper-layer packet length is zero in psh
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+		s = checksumAdd(checksumAdd(0, psh), l[:])
+	}
+	c := checksumFold(checksumAdd(s, b))
+	b[2] = byte(c)
+	b[3] = byte(c >> 8)
+}
+
+// checksumAdd adds b to the ones' complement sum s, b is padded with zero
+// if odd, so only the last part may be odd
+func checksumAdd(s uint32, b []byte) uint32 {
+	n := len(b) - 1
+	for i := 0; i < n; i += 2 {
+		s += uint32(b[i+1])<<8 | uint32(b[i])
+	}
+	if n&1 == 0 {
+		s += uint32(b[n])
+	}
+	return s
+}
+
+func checksumFold(s uint32) uint16 {
+	s = s>>16 + s&0xffff
+	s = s + s>>16
+	return ^uint16(s)
+}
@@ -0,0 +1,87 @@
+package proto
+
+import (
+	"bytes"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"testing"
+)
+
+func TestPutEcho(t *testing.T) {
+	data := []byte("odd sized echo data")
+	src, dst := net.ParseIP("fe80::1"), net.ParseIP("fe80::2")
+	if psh := FamilyV6.PseudoHeader(src, dst); !bytes.Equal(psh, icmp.IPv6PseudoHeader(src, dst)) {
+		t.Fatalf("pseudo header %x", psh)
+	}
+	for _, tc := range []struct {
+		family *Family
+		typ    icmp.Type
+		psh    []byte
+	}{
+		{FamilyV4, ipv4.ICMPTypeEcho, nil},
+		{FamilyV6, ipv6.ICMPTypeEchoRequest, FamilyV6.PseudoHeader(src, dst)},
+	} {
+		msg := icmp.Message{
+			Type: tc.typ,
+			Body: &icmp.Echo{ID: 0x1234, Seq: 0xfedc, Data: data},
+		}
+		want, err := msg.Marshal(tc.psh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, EchoHeaderLen+len(data))
+		copy(b[EchoHeaderLen:], data)
+		tc.family.PutEcho(b, tc.family.EchoRequestType, 0x1234, 0xfedc, tc.psh)
+		if !bytes.Equal(b, want) {
+			t.Fatalf("%s: put echo %x, want %x", tc.family.Network, b, want)
+		}
+
+		echo, err := ParseEcho(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if echo.Type != tc.family.EchoRequestType || echo.ID != 0x1234 || echo.Seq != 0xfedc || !bytes.Equal(echo.Data, data) {
+			t.Fatalf("parse echo %+v", echo)
+		}
+	}
+}
+
+func BenchmarkEchoMarshal(b *testing.B) {
+	data := make([]byte, 1400)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeEchoReply,
+			Body: &icmp.Echo{ID: 1, Seq: i, Data: data},
+		}
+		_, _ = msg.Marshal(nil)
+	}
+}
+
+func BenchmarkPutEcho(b *testing.B) {
+	buf := make([]byte, EchoHeaderLen+1400)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		FamilyV4.PutEcho(buf, FamilyV4.EchoReplyType, 1, uint16(i), nil)
+	}
+}
+
+func BenchmarkEchoParse(b *testing.B) {
+	buf := make([]byte, EchoHeaderLen+1400)
+	FamilyV4.PutEcho(buf, FamilyV4.EchoReplyType, 1, 1, nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = icmp.ParseMessage(1, buf)
+	}
+}
+
+func BenchmarkParseEcho(b *testing.B) {
+	buf := make([]byte, EchoHeaderLen+1400)
+	FamilyV4.PutEcho(buf, FamilyV4.EchoReplyType, 1, 1, nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = ParseEcho(buf)
+	}
+}
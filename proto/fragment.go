@@ -0,0 +1,127 @@
+package proto
+
+import (
+	"errors"
+	"gvisor.dev/gvisor/pkg/binary"
+	"time"
+)
+
+// FragmentHeaderLen is the size of fragment header at the beginning of
+// payload: id uint16, index uint8, count uint8
+const FragmentHeaderLen = 4
+
+const (
+	maxFragmentCount = 255
+	maxPartials      = 64
+)
+
+var ErrTooLarge = errors.New("packet too large")
+
+// Fragment splits payload into layers with FlagFragment set,
+// each payload is no more than size bytes including fragment header.
+func Fragment(id uint16, payload []byte, size int) ([]Layer, error) {
+	chunk := size - FragmentHeaderLen
+	if chunk <= 0 {
+		return nil, ErrTooLarge
+	}
+	count := (len(payload) + chunk - 1) / chunk
+	if count > maxFragmentCount {
+		return nil, ErrTooLarge
+	}
+	layers := make([]Layer, count)
+	for i := range layers {
+		part := payload[i*chunk : min((i+1)*chunk, len(payload))]
+		buf := make([]byte, FragmentHeaderLen+len(part))
+		binary.LittleEndian.PutUint16(buf[0:2], id)
+		buf[2] = uint8(i)
+		buf[3] = uint8(count)
+		copy(buf[FragmentHeaderLen:], part)
+		layers[i] = Layer{Flags: FlagFragment, Payload: buf}
+	}
+	return layers, nil
+}
+
+// Split returns payload as a single layer if it fits in size, or its fragments
+func Split(id uint16, payload []byte, size int) ([]Layer, error) {
+	if len(payload) <= size {
+		return []Layer{{Payload: payload}}, nil
+	}
+	return Fragment(id, payload, size)
+}
+
+type partial struct {
+	parts    [][]byte
+	received int
+	deadline time.Time
+}
+
+// Reassembler collects fragments, incomplete packets are dropped after timeout.
+// Not safe for concurrent use.
+type Reassembler struct {
+	timeout  time.Duration
+	partials map[uint16]*partial
+}
+
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		timeout:  timeout,
+		partials: make(map[uint16]*partial),
+	}
+}
+
+// Add returns the whole packet once all fragments of it arrived, or nil.
+// The fragment is copied, so payload may be reused.
+func (r *Reassembler) Add(payload []byte) ([]byte, error) {
+	if len(payload) < FragmentHeaderLen {
+		return nil, ErrFormat
+	}
+	id := binary.LittleEndian.Uint16(payload[0:2])
+	index, count := int(payload[2]), int(payload[3])
+	if index >= count {
+		return nil, ErrFormat
+	}
+
+	now := time.Now()
+	p, ok := r.partials[id]
+	if ok && (len(p.parts) != count || now.After(p.deadline)) {
+		// stale packet with the same id
+		delete(r.partials, id)
+		ok = false
+	}
+	if !ok {
+		r.expire(now)
+		if len(r.partials) >= maxPartials {
+			return nil, ErrTooLarge
+		}
+		p = &partial{parts: make([][]byte, count), deadline: now.Add(r.timeout)}
+		r.partials[id] = p
+	}
+	if p.parts[index] != nil {
+		// duplicate
+		return nil, nil
+	}
+	p.parts[index] = append([]byte(nil), payload[FragmentHeaderLen:]...)
+	p.received++
+	if p.received < count {
+		return nil, nil
+	}
+
+	delete(r.partials, id)
+	size := 0
+	for _, part := range p.parts {
+		size += len(part)
+	}
+	packet := make([]byte, 0, size)
+	for _, part := range p.parts {
+		packet = append(packet, part...)
+	}
+	return packet, nil
+}
+
+func (r *Reassembler) expire(now time.Time) {
+	for id, p := range r.partials {
+		if now.After(p.deadline) {
+			delete(r.partials, id)
+		}
+	}
+}
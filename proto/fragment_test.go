@@ -0,0 +1,61 @@
+package proto
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+func TestFragment(t *testing.T) {
+	payload := make([]byte, 65535)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	layers, err := Fragment(7, payload, 1400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 47 {
+		t.Fatalf("fragment count %d", len(layers))
+	}
+
+	r := NewReassembler(time.Second)
+	rand.Shuffle(len(layers), func(i, j int) { layers[i], layers[j] = layers[j], layers[i] })
+	for i, l := range layers {
+		if len(l.Payload) > 1400 || l.Flags&FlagFragment == 0 {
+			t.Fatalf("invalid fragment %d", i)
+		}
+		got, err := r.Add(l.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < len(layers)-1 {
+			if got != nil {
+				t.Fatalf("reassembled early at %d", i)
+			}
+			continue
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatal("reassembled packet mismatch")
+		}
+	}
+
+	if _, err := Fragment(1, payload, 64); err != ErrTooLarge {
+		t.Fatalf("expect too large, got %v", err)
+	}
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	layers, _ := Fragment(1, make([]byte, 300), 104)
+	r := NewReassembler(10 * time.Millisecond)
+	if _, err := r.Add(layers[0].Payload); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	for _, l := range layers[1:] {
+		if got, _ := r.Add(l.Payload); got != nil {
+			t.Fatal("expired fragment used")
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package proto
+
+import (
+	"errors"
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+const (
+	// HandshakeLen is the size of Handshake
+	HandshakeLen = 10
+	// Magic begins every Handshake as bytes, it has no byte order
+	Magic = "AICT"
+	// Version is the protocol version of this implementation,
+	// streams advertise a receive window since 2
+	Version uint8 = 2
+	// MinVersion is the oldest version this implementation speaks
+	MinVersion uint8 = 2
+)
+
+// Capabilities of a peer, the server replies with the ones both support
+const (
+	CapEncryption = 1 << iota
+	CapCompression
+	CapFragmentation
+)
+
+var (
+	ErrMagic   = errors.New("not an aict handshake")
+	ErrVersion = errors.New("unsupported protocol version")
+)
+
+// Handshake is the payload of FlagHandshake layers. The client sends it
+// when it starts or redials, the server creates sessions only by it
+// and replies with the negotiated version and capabilities.
+type Handshake struct {
+	Version      uint8
+	Capabilities uint8
+	// Session is chosen by client at random, a new one resets
+	// the server session of the same source ip and echo id.
+	Session uint32
+}
+
+func (h *Handshake) Marshal() []byte {
+	buf := make([]byte, HandshakeLen)
+	copy(buf[0:4], Magic)
+	buf[4] = h.Version
+	buf[5] = h.Capabilities
+	binary.LittleEndian.PutUint32(buf[6:10], h.Session)
+	return buf
+}
+
+func (h *Handshake) Unmarshal(b []byte) error {
+	if len(b) < HandshakeLen {
+		return ErrFormat
+	}
+	if string(b[0:4]) != Magic {
+		return ErrMagic
+	}
+	h.Version = b[4]
+	h.Capabilities = b[5]
+	h.Session = binary.LittleEndian.Uint32(b[6:10])
+	return nil
+}
+
+// Negotiate returns the reply of server with caps to the handshake,
+// ErrVersion if the client is too old.
+func (h *Handshake) Negotiate(caps uint8) (Handshake, error) {
+	if h.Version < MinVersion {
+		return Handshake{}, ErrVersion
+	}
+	return Handshake{
+		Version:      min(h.Version, Version),
+		Capabilities: h.Capabilities & caps,
+		Session:      h.Session,
+	}, nil
+}
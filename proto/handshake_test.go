@@ -0,0 +1,35 @@
+package proto
+
+import (
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	h := Handshake{Version: 7, Capabilities: CapEncryption | CapCompression, Session: 0xdeadbeef}
+	b := h.Marshal()
+	if string(b[:4]) != "AICT" {
+		t.Fatalf("magic %q", b[:4])
+	}
+	var got Handshake
+	if err := got.Unmarshal(b); err != nil || got != h {
+		t.Fatalf("got %+v %v", got, err)
+	}
+
+	reply, err := got.Negotiate(CapEncryption | CapFragmentation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Version != Version || reply.Capabilities != CapEncryption || reply.Session != h.Session {
+		t.Fatalf("reply %+v", reply)
+	}
+
+	old := Handshake{Version: MinVersion - 1}
+	if _, err := old.Negotiate(0); err != ErrVersion {
+		t.Fatalf("old version: %v", err)
+	}
+
+	// a ping from monitoring tools
+	if err := got.Unmarshal([]byte("abcdefghijklmnop")); err != ErrMagic {
+		t.Fatalf("bad magic: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package proto
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+)
+
+// Family is the icmp echo parameters of an address family
+type Family struct {
+	// Network for icmp.ListenPacket
+	Network string
+	// DatagramNetwork for icmp.ListenPacket, unprivileged ping socket on linux
+	DatagramNetwork string
+	// EchoRequestType and EchoReplyType are the type bytes of Echo
+	EchoRequestType uint8
+	EchoReplyType   uint8
+}
+
+var (
+	FamilyV4 = &Family{
+		Network:         "ip4:icmp",
+		DatagramNetwork: "udp4",
+		EchoRequestType: uint8(ipv4.ICMPTypeEcho),
+		EchoReplyType:   uint8(ipv4.ICMPTypeEchoReply),
+	}
+	FamilyV6 = &Family{
+		Network:         "ip6:ipv6-icmp",
+		DatagramNetwork: "udp6",
+		EchoRequestType: uint8(ipv6.ICMPTypeEchoRequest),
+		EchoReplyType:   uint8(ipv6.ICMPTypeEchoReply),
+	}
+)
+
+// AddrIP returns the ip of addresses returned by icmp.PacketConn,
+// which is *net.IPAddr for raw sockets and *net.UDPAddr for datagram sockets
+func AddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
+
+// FamilyOf returns the family of ip
+func FamilyOf(ip net.IP) *Family {
+	if ip.To4() != nil {
+		return FamilyV4
+	}
+	return FamilyV6
+}
+
+// PseudoHeader returns the pseudo header for PutEcho, like icmp.IPv6PseudoHeader.
+// ICMPv6 checksum covers src and dst, nil is returned for ICMPv4 or
+// an unspecified src, then the kernel fills the checksum of raw ICMPv6 sockets.
+func (f *Family) PseudoHeader(src, dst net.IP) []byte {
+	if f != FamilyV6 || src == nil || src.IsUnspecified() {
+		return nil
+	}
+	// src, dst, upper-layer packet length left zero and next header
+	psh := make([]byte, 2*net.IPv6len+8)
+	copy(psh, src.To16())
+	copy(psh[net.IPv6len:], dst.To16())
+	psh[len(psh)-1] = ianaProtocolIPv6ICMP
+	return psh
+}
+
+const ianaProtocolIPv6ICMP = 58
@@ -0,0 +1,82 @@
+package proto
+
+import (
+	"github.com/BaiMeow/aict/ds"
+	"io"
+)
+
+// PacketBufferSize fits a packet of common mtu, larger ones are not pooled
+const PacketBufferSize = 2048
+
+// PacketPool holds the packets queued or read by client and server conns
+var PacketPool = ds.NewBufferPool(PacketBufferSize)
+
+// CopyPacket copies data into a pooled buffer, unless it is too large
+func CopyPacket(data []byte) *ds.Buffer {
+	if len(data) > PacketPool.Size() {
+		return &ds.Buffer{B: append([]byte(nil), data...)}
+	}
+	b := PacketPool.Get()
+	b.B = b.B[:copy(b.B, data)]
+	return b
+}
+
+// CompressPacket deflates data into a pooled buffer, unless it is too large.
+// It returns nil if data is too short or doesn't shrink.
+func CompressPacket(data []byte) *ds.Buffer {
+	if len(data) < MinCompressLen {
+		return nil
+	}
+	var b *ds.Buffer
+	if len(data) > PacketPool.Size() {
+		b = &ds.Buffer{B: make([]byte, len(data))}
+	} else {
+		b = PacketPool.Get()
+	}
+	out, ok := Compress(b.B, data)
+	if !ok {
+		PacketPool.Put(b)
+		return nil
+	}
+	b.B = out
+	return b
+}
+
+// EncodeTo marshals the layer into the echo data b and, if c is not nil, seals it
+// in place with a nonce of nonces for an echo of typ and id.
+// It returns the length of echo data.
+func EncodeTo(b []byte, l *Layer, c *Cipher, nonces *NonceSource, typ uint8, id uint16) (int, error) {
+	if c == nil {
+		return l.MarshalTo(b)
+	}
+	overhead := c.Overhead()
+	if len(b) < overhead {
+		return 0, io.ErrShortBuffer
+	}
+	// leave room for the tag, so Seal doesn't grow b
+	n, err := l.MarshalTo(b[NonceSize : len(b)-overhead+NonceSize])
+	if err != nil {
+		return 0, err
+	}
+	return len(c.Seal(b[:0], nonces.Next(), b[NonceSize:NonceSize+n], typ, id)), nil
+}
+
+// Decode opens the echo data in place if c is not nil and unmarshal the layer,
+// whose payload aliases the echo data. The nonce is returned for the replay check,
+// it is zero without c.
+func Decode(msg *Layer, echo *Echo, c *Cipher) (Nonce, error) {
+	var nonce Nonce
+	data := echo.Data
+	if c != nil {
+		if len(data) < c.Overhead() {
+			return nonce, ErrFormat
+		}
+		plain, n, err := c.Open(data[NonceSize:NonceSize], data, echo.Type, echo.ID)
+		if err != nil {
+			return nonce, err
+		}
+		data = plain
+		nonce = n
+	}
+	return nonce, msg.UnmarshalFrom(data)
+}
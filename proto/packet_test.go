@@ -0,0 +1,61 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	c, _ := NewCipher([]byte("secret"), ClientToServer)
+	s, _ := NewCipher([]byte("secret"), ServerToClient)
+	for _, tc := range []struct {
+		name       string
+		seal, open *Cipher
+	}{
+		{"plain", nil, nil},
+		{"sealed", c, s},
+	} {
+		nonces := NewNonceSource()
+		b := make([]byte, 256)
+		l := Layer{Flags: FlagPing, Payload: []byte("hello")}
+		n, err := EncodeTo(b, &l, tc.seal, nonces, 8, 1234)
+		if err != nil {
+			t.Fatalf("%s: encode: %v", tc.name, err)
+		}
+		var msg Layer
+		nonce, err := Decode(&msg, &Echo{Type: 8, ID: 1234, Data: b[:n]}, tc.open)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", tc.name, err)
+		}
+		if msg.Flags != FlagPing || !bytes.Equal(msg.Payload, l.Payload) {
+			t.Fatalf("%s: decoded %+v", tc.name, msg)
+		}
+		if tc.seal != nil && nonce == (Nonce{}) {
+			t.Fatalf("%s: no nonce", tc.name)
+		}
+	}
+
+	if _, err := EncodeTo(make([]byte, 8), &Layer{}, c, NewNonceSource(), 8, 1234); err == nil {
+		t.Fatal("encode into short buffer")
+	}
+}
+
+func TestCopyPacket(t *testing.T) {
+	data := []byte("hello")
+	b := CopyPacket(data)
+	if !bytes.Equal(b.B, data) {
+		t.Fatalf("copied %q", b.B)
+	}
+	PacketPool.Put(b)
+
+	large := make([]byte, PacketBufferSize+1)
+	if b := CopyPacket(large); len(b.B) != len(large) {
+		t.Fatalf("copied %d bytes", len(b.B))
+	}
+	if CompressPacket(data) != nil {
+		t.Fatal("short packet compressed")
+	}
+	if b := CompressPacket(bytes.Repeat(data, 100)); b == nil || len(b.B) >= 500 {
+		t.Fatal("repeated packet not compressed")
+	}
+}
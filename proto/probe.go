@@ -0,0 +1,33 @@
+package proto
+
+import (
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+// ProbeLen is the size of Probe before padding
+const ProbeLen = 4
+
+// Probe is the payload of FlagPing layers, the peer replies
+// with the same payload right away using the echo's own id and seq.
+type Probe struct {
+	ID uint16
+	// EchoSize announces the echo size confirmed by path mtu discovery, 0 if unknown
+	EchoSize uint16
+}
+
+// Marshal pads the probe with zero to size bytes
+func (p *Probe) Marshal(size int) []byte {
+	buf := make([]byte, max(size, ProbeLen))
+	binary.LittleEndian.PutUint16(buf[0:2], p.ID)
+	binary.LittleEndian.PutUint16(buf[2:4], p.EchoSize)
+	return buf
+}
+
+func (p *Probe) Unmarshal(b []byte) error {
+	if len(b) < ProbeLen {
+		return ErrFormat
+	}
+	p.ID = binary.LittleEndian.Uint16(b[0:2])
+	p.EchoSize = binary.LittleEndian.Uint16(b[2:4])
+	return nil
+}
@@ -3,6 +3,8 @@ package proto
 import (
 	"errors"
 	"gvisor.dev/gvisor/pkg/binary"
+	"io"
+	"math"
 )
 
 const (
@@ -10,8 +12,28 @@ const (
 	FlagPing = 1 << iota
 	// no reply
 	FlagKeepalive
+	// payload is a fragment, see Fragment
+	FlagFragment
+	// payload begins with Credit, sent by server
+	FlagCredit
+	// payload is Handshake, starts a session and is replied right now
+	FlagHandshake
+	// the session is closed by the sender
+	FlagClose
+	// payload is deflated, see Compress. Fragments carry it if the whole packet is.
+	FlagCompress
 )
 
+// close reasons, the payload of FlagClose, empty means CloseNormal
+const (
+	CloseNormal uint8 = iota
+	// the session is replaced by a newer client, the peer shouldn't take it back
+	CloseTakenOver
+)
+
+// HeaderLen is the size of Layer before payload
+const HeaderLen = 3
+
 var ErrFormat = errors.New("invalid format")
 
 type Layer struct {
@@ -23,27 +45,55 @@ type Layer struct {
 }
 
 func (l *Layer) Unmarshal(b []byte) error {
-	if len(b) < 3 {
+	if len(b) < HeaderLen {
+		return ErrFormat
+	}
+	if err := l.UnmarshalFrom(b); err != nil {
+		return err
+	}
+	l.Payload = append([]byte(nil), l.Payload...)
+	return nil
+}
+
+// UnmarshalFrom is Unmarshal without copy, Payload aliases b
+func (l *Layer) UnmarshalFrom(b []byte) error {
+	if len(b) < HeaderLen {
 		return ErrFormat
 	}
 	l.Flags = b[0]
 	l.Len = binary.LittleEndian.Uint16(b[1:3])
-	if len(b) != int(l.Len)+3 {
+	if len(b) != int(l.Len)+HeaderLen {
 		return ErrFormat
 	}
-	l.Payload = make([]byte, l.Len)
-	copy(l.Payload, b[3:])
+	l.Payload = b[HeaderLen:]
 	return nil
 }
 
 // Marshal also fill Len field
 func (l *Layer) Marshal() ([]byte, error) {
-	buf := make([]byte, 3+len(l.Payload))
+	buf := make([]byte, HeaderLen+len(l.Payload))
+	return buf, l.put(buf)
+}
+
+// MarshalTo is Marshal into b, it returns the bytes written
+// or io.ErrShortBuffer if b is too small
+func (l *Layer) MarshalTo(b []byte) (int, error) {
+	n := HeaderLen + len(l.Payload)
+	if len(b) < n {
+		return 0, io.ErrShortBuffer
+	}
+	return n, l.put(b[:n])
+}
+
+func (l *Layer) put(b []byte) error {
+	if len(l.Payload) > math.MaxUint16 {
+		return ErrTooLarge
+	}
 	l.Len = uint16(len(l.Payload))
-	buf[0] = l.Flags
-	binary.LittleEndian.PutUint16(buf[1:3], l.Len)
-	copy(buf[3:], l.Payload)
-	return buf, nil
+	b[0] = l.Flags
+	binary.LittleEndian.PutUint16(b[1:3], l.Len)
+	copy(b[HeaderLen:], l.Payload)
+	return nil
 }
 
 type IdSeqPair struct {
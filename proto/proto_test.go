@@ -0,0 +1,66 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestLayerMarshalTo(t *testing.T) {
+	l := Layer{Flags: FlagFragment, Payload: []byte("payload")}
+	buf := make([]byte, 64)
+	n, err := l.MarshalTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := l.Marshal()
+	if !bytes.Equal(buf[:n], want) {
+		t.Fatalf("marshal to %x, want %x", buf[:n], want)
+	}
+	if _, err := l.MarshalTo(buf[:n-1]); err != io.ErrShortBuffer {
+		t.Fatalf("short buffer: %v", err)
+	}
+
+	var got Layer
+	if err := got.UnmarshalFrom(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if got.Flags != l.Flags || !bytes.Equal(got.Payload, l.Payload) || &got.Payload[0] != &buf[HeaderLen] {
+		t.Fatalf("unmarshal from %+v", got)
+	}
+}
+
+func BenchmarkLayerMarshal(b *testing.B) {
+	l := Layer{Payload: make([]byte, 1280)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = l.Marshal()
+	}
+}
+
+func BenchmarkLayerMarshalTo(b *testing.B) {
+	l := Layer{Payload: make([]byte, 1280)}
+	buf := make([]byte, 2048)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = l.MarshalTo(buf)
+	}
+}
+
+func BenchmarkLayerUnmarshal(b *testing.B) {
+	data, _ := (&Layer{Payload: make([]byte, 1280)}).Marshal()
+	var l Layer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = l.Unmarshal(data)
+	}
+}
+
+func BenchmarkLayerUnmarshalFrom(b *testing.B) {
+	data, _ := (&Layer{Payload: make([]byte, 1280)}).Marshal()
+	var l Layer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = l.UnmarshalFrom(data)
+	}
+}
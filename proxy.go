@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BaiMeow/aict/mux"
+	"github.com/BaiMeow/aict/stream"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// connect to the target
+	proxyCmdConnect = iota + 1
+	// listen on an address, connections are proxied back as
+	// connect requests, the address is in format <listen>=<target>
+	proxyCmdListen
+)
+
+const (
+	proxyStatusOK = iota
+	proxyStatusFailed
+	proxyStatusDenied
+)
+
+const proxyDialTimeout = 10 * time.Second
+
+// proxy request on a new mux stream: [cmd uint8][len uint8][address],
+// answered by one status byte before any data.
+
+func writeProxyRequest(c net.Conn, cmd byte, addr string) error {
+	if len(addr) > 255 {
+		return errors.New("address too long")
+	}
+	_, err := c.Write(append([]byte{cmd, byte(len(addr))}, addr...))
+	return err
+}
+
+func readProxyRequest(c net.Conn) (byte, string, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c, head[:]); err != nil {
+		return 0, "", err
+	}
+	addr := make([]byte, head[1])
+	if _, err := io.ReadFull(c, addr); err != nil {
+		return 0, "", err
+	}
+	return head[0], string(addr), nil
+}
+
+// requestProxy opens a stream in session and sends the request to the peer
+func requestProxy(session *mux.Session, cmd byte, addr string) (net.Conn, error) {
+	c, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeProxyRequest(c, cmd, addr); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	var status [1]byte
+	if _, err := io.ReadFull(c, status[:]); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	switch status[0] {
+	case proxyStatusOK:
+		return c, nil
+	case proxyStatusDenied:
+		_ = c.Close()
+		return nil, fmt.Errorf("peer denied %s", addr)
+	default:
+		_ = c.Close()
+		return nil, fmt.Errorf("peer failed on %s", addr)
+	}
+}
+
+// dialProxy asks the peer to connect target
+func dialProxy(session *mux.Session, target string) (net.Conn, error) {
+	return requestProxy(session, proxyCmdConnect, target)
+}
+
+// proxyPolicy filters the requests of the peer, a nil func denies all
+type proxyPolicy struct {
+	connect func(target string) bool
+	// listen gets the request address <listen>=<target>
+	listen func(addr string) bool
+}
+
+func allowAll(string) bool { return true }
+
+// openProxy lets the peer connect anywhere and listen on any address
+var openProxy = proxyPolicy{connect: allowAll, listen: allowAll}
+
+// serverPolicy is what clients may ask the server of pipe for.
+// proxy is an open relay, socks5 connects anywhere, forward connects
+// to its targets and reverse listens on its addresses for its targets.
+func serverPolicy(pipe, arg string) (proxyPolicy, error) {
+	switch pipe {
+	case "proxy":
+		return openProxy, nil
+	case "socks5":
+		return proxyPolicy{connect: allowAll}, nil
+	case "forward", "reverse":
+		rules, err := parseForwardRules(arg)
+		if err != nil {
+			return proxyPolicy{}, fmt.Errorf("parse %s: %v", pipe, err)
+		}
+		allowed := make(map[string]bool)
+		for _, rule := range rules {
+			if pipe == "forward" {
+				allowed[rule.target] = true
+			} else {
+				allowed[rule.listen+"="+rule.target] = true
+			}
+		}
+		allow := func(addr string) bool { return allowed[addr] }
+		if pipe == "forward" {
+			return proxyPolicy{connect: allow}, nil
+		}
+		return proxyPolicy{listen: allow}, nil
+	default:
+		return proxyPolicy{}, fmt.Errorf("no proxy policy for pipe %s", pipe)
+	}
+}
+
+// proxyUp serves the proxy requests of the peer allowed by policy
+func proxyUp(conn Conn, logger *slog.Logger, client bool, policy proxyPolicy) {
+	p := &proxyServer{
+		session: mux.New(conn, client, &stream.Config{Logger: logger}),
+		policy:  policy,
+		log:     logger,
+	}
+	p.serve()
+}
+
+// proxyServer serves proxy requests from the peer of session
+type proxyServer struct {
+	session *mux.Session
+	policy  proxyPolicy
+	log     *slog.Logger
+
+	lock      sync.Mutex
+	listeners []net.Listener
+}
+
+// serve returns when session ends, listeners opened for the peer are closed
+func (p *proxyServer) serve() {
+	defer func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		for _, ln := range p.listeners {
+			_ = ln.Close()
+		}
+	}()
+	for {
+		c, err := p.session.Accept()
+		if err != nil {
+			p.log.Info("proxy: accept", "err", err)
+			return
+		}
+		go p.handle(c)
+	}
+}
+
+func (p *proxyServer) handle(c net.Conn) {
+	cmd, addr, err := readProxyRequest(c)
+	if err != nil {
+		p.log.Warn("proxy: read request", "err", err)
+		_ = c.Close()
+		return
+	}
+	switch {
+	case cmd == proxyCmdConnect && p.policy.connect != nil && p.policy.connect(addr):
+		p.connect(c, addr)
+	case cmd == proxyCmdListen && p.policy.listen != nil && p.policy.listen(addr):
+		p.listen(c, addr)
+	default:
+		p.log.Warn("proxy: deny", "cmd", cmd, "addr", addr)
+		_, _ = c.Write([]byte{proxyStatusDenied})
+		_ = c.Close()
+	}
+}
+
+func (p *proxyServer) connect(c net.Conn, target string) {
+	tc, err := net.DialTimeout("tcp", target, proxyDialTimeout)
+	if err != nil {
+		p.log.Warn("proxy: dial", "target", target, "err", err)
+		_, _ = c.Write([]byte{proxyStatusFailed})
+		_ = c.Close()
+		return
+	}
+	if _, err := c.Write([]byte{proxyStatusOK}); err != nil {
+		_ = c.Close()
+		_ = tc.Close()
+		return
+	}
+	join(c, tc)
+}
+
+func (p *proxyServer) listen(c net.Conn, addr string) {
+	defer c.Close()
+	listen, target, ok := strings.Cut(addr, "=")
+	if !ok {
+		p.log.Warn("proxy: invalid listen request", "addr", addr)
+		_, _ = c.Write([]byte{proxyStatusFailed})
+		return
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		p.log.Warn("proxy: listen", "addr", listen, "err", err)
+		_, _ = c.Write([]byte{proxyStatusFailed})
+		return
+	}
+	p.lock.Lock()
+	p.listeners = append(p.listeners, ln)
+	p.lock.Unlock()
+	if _, err := c.Write([]byte{proxyStatusOK}); err != nil {
+		_ = ln.Close()
+		return
+	}
+	p.log.Info("proxy: forward to peer", "listen", ln.Addr().String(), "target", target)
+	go forwardListener(p.session, p.log, ln, target)
+}
+
+// forwardListener proxies every connection of ln to target through the peer
+func forwardListener(session *mux.Session, logger *slog.Logger, ln net.Listener, target string) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warn("forward: accept", "err", err)
+			}
+			return
+		}
+		go func() {
+			pc, err := dialProxy(session, target)
+			if err != nil {
+				logger.Warn("forward: dial peer", "target", target, "err", err)
+				_ = c.Close()
+				return
+			}
+			join(c, pc)
+		}()
+	}
+}
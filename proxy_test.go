@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestServerPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		pipe, arg       string
+		connect, listen string
+		allowConnect    bool
+		allowListen     bool
+	}{
+		{"proxy", "", "10.0.0.5:22", "0.0.0.0:22=127.0.0.1:22", true, true},
+		{"socks5", "1080", "10.0.0.5:22", "0.0.0.0:22=127.0.0.1:22", true, false},
+		{"forward", "127.0.0.1:2222=10.0.0.5:22", "10.0.0.5:22", "127.0.0.1:2222=10.0.0.5:22", true, false},
+		{"forward", "127.0.0.1:2222=10.0.0.5:22", "10.0.0.6:22", "", false, false},
+		{"reverse", "0.0.0.0:2222=127.0.0.1:22", "127.0.0.1:22", "0.0.0.0:2222=127.0.0.1:22", false, true},
+		{"reverse", "0.0.0.0:2222=127.0.0.1:22", "", "0.0.0.0:22=127.0.0.1:22", false, false},
+	} {
+		p, err := serverPolicy(tc.pipe, tc.arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotConnect := p.connect != nil && p.connect(tc.connect)
+		gotListen := p.listen != nil && p.listen(tc.listen)
+		if gotConnect != tc.allowConnect || gotListen != tc.allowListen {
+			t.Fatalf("%s:%s connect %s %v, listen %s %v", tc.pipe, tc.arg, tc.connect, gotConnect, tc.listen, gotListen)
+		}
+	}
+	if _, err := serverPolicy("forward", "10.0.0.5:22"); err == nil {
+		t.Fatal("invalid rule accepted")
+	}
+}
@@ -5,188 +5,478 @@ import (
 	"errors"
 	"fmt"
 	"github.com/BaiMeow/aict/ds"
+	"github.com/BaiMeow/aict/metrics"
 	"github.com/BaiMeow/aict/proto"
-	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
-	"log"
+	"io"
+	"log/slog"
+	"math"
 	"net"
+	"os"
+	"sync/atomic"
 	"time"
 )
 
-const bufferSize = 1500
+const (
+	bufferSize        = 65535
+	reassembleTimeout = 5 * time.Second
+)
+
+var ErrConnClosed = errors.New("connection closed")
+
+// echoPool holds buffers to encode echoes in
+var echoPool = ds.NewBufferPool(bufferSize)
+
+// packet is a layer queued for writeRoutine, buf is recycled once sent
+type packet struct {
+	layer proto.Layer
+	buf   *ds.Buffer
+}
 
+// AictConn is a session with a single client, identified by
+// its source ip and echo id. It is created by Listener.
 type AictConn struct {
-	conn        net.PacketConn
-	readBuffer  chan []byte
-	writeBuffer chan []byte
-	initialized chan struct{}
+	l           *Listener
+	key         sessionKey
+	readBuffer  chan *ds.Buffer
+	writeBuffer chan packet
 
 	cancel context.CancelFunc
 	ctx    context.Context
 
-	raddr             *net.IPAddr
-	identify          uint16
-	sequenceQueue     *ds.RotatedQueue[proto.IdSeqPair]
-	sequenceQueueSize int
+	raddr    *net.IPAddr
+	psh      []byte
+	identify uint16
+	// session, version and caps are negotiated by Handshake
+	session uint32
+	version uint8
+	caps    uint8
+	// lastSeen is the unix nano of the last echo from client
+	lastSeen      atomic.Int64
+	sequenceQueue *ds.ExpiringQueue[proto.IdSeqPair]
+
+	nonce *proto.NonceSource
+
+	// maxPayload is the max layer payload in one echo, larger packets are fragmented
+	maxPayload  atomic.Int32
+	fragmentID  atomic.Uint32
+	reassembler *proto.Reassembler
+	// pmtuDone is closed when the client announces its path mtu
+	pmtuDone chan struct{}
+
+	readDeadline  *ds.Deadline
+	writeDeadline *ds.Deadline
+
+	metrics metrics.Metrics
+	// log has the peer, id and session attached
+	log *slog.Logger
 }
 
-func newAict(c net.PacketConn, raddr *net.IPAddr, cfg *Config) *AictConn {
-	ctx, cancel := context.WithCancel(context.Background())
+// newAict starts the session negotiated by the handshake reply h
+func newAict(l *Listener, key sessionKey, raddr *net.IPAddr, h *proto.Handshake) *AictConn {
+	ctx, cancel := context.WithCancel(l.ctx)
 	aict := &AictConn{
-		conn:              c,
-		readBuffer:        make(chan []byte, 1024),
-		writeBuffer:       make(chan []byte, 1024),
-		initialized:       make(chan struct{}),
-		ctx:               ctx,
-		cancel:            cancel,
-		raddr:             raddr,
-		sequenceQueueSize: cfg.SeqQueueSize,
-		sequenceQueue:     ds.NewRotatedQueue[proto.IdSeqPair](cfg.SeqQueueSize),
+		l:             l,
+		key:           key,
+		readBuffer:    make(chan *ds.Buffer, 1024),
+		writeBuffer:   make(chan packet, 1024),
+		ctx:           ctx,
+		cancel:        cancel,
+		raddr:         raddr,
+		psh:           l.family.PseudoHeader(l.laddr.IP, raddr.IP),
+		identify:      key.id,
+		session:       h.Session,
+		version:       h.Version,
+		caps:          h.Capabilities,
+		sequenceQueue: ds.NewExpiringQueue[proto.IdSeqPair](l.cfg.SeqQueueSize, l.cfg.SeqTTL),
+		nonce:         proto.NewNonceSource(),
+		reassembler:   proto.NewReassembler(reassembleTimeout),
+		pmtuDone:      make(chan struct{}),
+		readDeadline:  ds.NewDeadline(),
+		writeDeadline: ds.NewDeadline(),
+		log:           l.log.With("peer", raddr.String(), "id", key.id, "session", fmt.Sprintf("%08x", h.Session)),
 	}
-	go func() {
-		err := aict.readRoutine()
-		if err != nil {
-			log.Printf("exit read loop: %v", err)
-		}
-	}()
+	aict.maxPayload.Store(int32(l.cfg.EchoSize - l.overhead))
+	aict.lastSeen.Store(time.Now().UnixNano())
 	go func() {
 		err := aict.writeRoutine()
 		if err != nil {
-			log.Printf("exit write loop: %v", err)
+			aict.log.Error("exit write loop", "err", err)
 		}
 	}()
 	return aict
 }
 
+// Close ends the session and tells the client if an id/seq pair is left,
+// the underlying socket is owned by Listener
 func (c *AictConn) Close() error {
+	return c.closeWithReason(proto.CloseNormal)
+}
+
+// Supersede ends the session replaced by a newer client,
+// the client is told not to redial and take it back
+func (c *AictConn) Supersede() error {
+	return c.closeWithReason(proto.CloseTakenOver)
+}
+
+func (c *AictConn) closeWithReason(reason uint8) error {
+	select {
+	case <-c.ctx.Done():
+		return nil
+	default:
+	}
+	var err error
+	if pair, ok := c.sequenceQueue.TryPop(); ok {
+		err = c.writeEcho(pair.Id, pair.Seq, &proto.Layer{Flags: proto.FlagClose, Payload: []byte{reason}})
+	}
+	c.shutdown()
+	return err
+}
+
+// shutdown ends the session silently
+func (c *AictConn) shutdown() {
 	c.cancel()
-	return c.conn.Close()
+	c.l.remove(c)
 }
 
-func (c *AictConn) readRoutine() error {
-	buf := make([]byte, bufferSize)
-	for {
-		// check context
-		select {
-		case <-c.ctx.Done():
-			return nil
-		default:
-		}
+func (c *AictConn) LocalAddr() net.Addr {
+	return c.l.Addr()
+}
 
-		err := c.conn.SetReadDeadline(time.Now().Add(time.Second * 30))
-		if err != nil {
-			return fmt.Errorf("icmp: set read deadline: %v", err)
-		}
-		n, addr, err := c.conn.ReadFrom(buf)
-		if err != nil {
-			// if not init
-			var netErr net.Error
-			if errors.As(err, &netErr) && c.identify == 0 && netErr.Timeout() {
-				continue
-			}
-			return fmt.Errorf("icmp: read from: %v", err)
-		}
+func (c *AictConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
 
-		m, err := icmp.ParseMessage(1, buf[:n])
-		if err != nil {
-			log.Printf("icmp: parse message: %v", err)
-			continue
-		}
+// Logger is Config.Logger with the peer and session attached
+func (c *AictConn) Logger() *slog.Logger {
+	return c.log
+}
 
-		echo, ok := m.Body.(*icmp.Echo)
-		if !ok || m.Type != ipv4.ICMPTypeEcho {
-			continue
-		}
+// ID is the echo id of the client, sessions from the same ip differ in it
+func (c *AictConn) ID() uint16 {
+	return c.identify
+}
 
-		msg := proto.Layer{}
-		if err := msg.Unmarshal(echo.Data); err != nil {
-			continue
-		}
+// SetDeadline sets the read and write deadlines, see net.Conn
+func (c *AictConn) SetDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	c.writeDeadline.Set(t)
+	return nil
+}
 
-		ipaddr, ok := addr.(*net.IPAddr)
-		if !ok {
-			return errors.New("PacketConn not return IPAddr")
-		}
-		// do init
-		if c.identify == 0 && (c.raddr.IP.Equal(net.IP{0, 0, 0, 0}) || c.raddr.IP.Equal(ipaddr.IP)) {
-			c.identify = uint16(echo.ID)
-			c.sequenceQueue = ds.NewRotatedQueue[proto.IdSeqPair](c.sequenceQueueSize)
-			c.raddr = ipaddr
-			close(c.initialized)
-			log.Println("accept connection from " + c.raddr.String())
+// SetReadDeadline makes reads return os.ErrDeadlineExceeded after t
+func (c *AictConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline makes writes blocked on a full queue return
+// os.ErrDeadlineExceeded after t, packets of a fragmented write may be sent partly
+func (c *AictConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Set(t)
+	return nil
+}
+
+// Metrics returns the counters of echoes and the gauges of queues
+func (c *AictConn) Metrics() metrics.Snapshot {
+	s := c.metrics.Snapshot()
+	s.SeqDropped = c.sequenceQueue.Dropped()
+	s.SeqQueueDepth = c.sequenceQueue.Fresh()
+	s.ReadQueue = len(c.readBuffer)
+	s.WriteQueue = len(c.writeBuffer)
+	return s
+}
+
+// FreshSequences is the count of id/seq pairs younger than Config.SeqTTL,
+// which the session can reply with
+func (c *AictConn) FreshSequences() int {
+	return c.sequenceQueue.Fresh()
+}
+
+// handle is called by the read loop of Listener for every echo of this session,
+// replay is checked by Listener. msg aliases the read buffer.
+func (c *AictConn) handle(echo *proto.Echo, msg *proto.Layer) {
+	c.lastSeen.Store(time.Now().UnixNano())
+	c.metrics.Received(len(echo.Data), msg.Flags&proto.FlagKeepalive > 0)
+	if c.log.Enabled(c.ctx, slog.LevelDebug) {
+		c.log.Debug("echo request", "seq", echo.Seq, "flags", msg.Flags, "len", len(echo.Data))
+	}
+
+	switch {
+	case msg.Flags&proto.FlagHandshake > 0:
+		// the session is created by this handshake or a retransmitted one
+		h := proto.Handshake{Version: c.version, Capabilities: c.caps, Session: c.session}
+		reply := proto.Layer{Flags: proto.FlagHandshake, Payload: h.Marshal()}
+		if err := c.writeEcho(echo.ID, echo.Seq, &reply); err != nil {
+			c.log.Warn("handshake reply", "seq", echo.Seq, "err", err)
 		}
+		return
+	case msg.Flags&proto.FlagClose > 0:
+		c.log.Info("client closes")
+		c.shutdown()
+		return
+	}
 
-		c.sequenceQueue.Push(proto.IdSeqPair{
-			Id:  uint16(echo.ID),
-			Seq: uint16(echo.Seq),
-		})
+	if msg.Flags&proto.FlagPing > 0 {
+		// reply with the echo itself, don't queue it
+		c.pong(echo, msg)
+		return
+	}
 
-		if msg.Flags&proto.FlagKeepalive > 0 {
-			continue
+	c.sequenceQueue.Push(proto.IdSeqPair{
+		Id:  echo.ID,
+		Seq: echo.Seq,
+	})
+
+	if msg.Flags&proto.FlagKeepalive > 0 {
+		return
+	}
+	payload := msg.Payload
+	fragment := msg.Flags&proto.FlagFragment > 0
+	if fragment {
+		var err error
+		payload, err = c.reassembler.Add(payload)
+		if err != nil {
+			c.log.Warn("reassemble", "seq", echo.Seq, "err", err)
+			return
 		}
+		if payload == nil {
+			return
+		}
+	}
+	var b *ds.Buffer
+	if msg.Flags&proto.FlagCompress > 0 {
+		var err error
+		payload, err = proto.Decompress(c.l.zbuf, payload)
+		if err != nil {
+			c.log.Warn("decompress", "seq", echo.Seq, "err", err)
+			return
+		}
+		b = proto.CopyPacket(payload)
+	} else if fragment {
+		// a new slice, not in the read buffer
+		b = &ds.Buffer{B: payload}
+	} else {
+		b = proto.CopyPacket(payload)
+	}
 
-		c.readBuffer <- msg.Payload
+	select {
+	case <-c.ctx.Done():
+		proto.PacketPool.Put(b)
+	case c.readBuffer <- b:
+	default:
+		// reader is too slow, don't block other sessions
+		c.metrics.Drops.Add(1)
+		proto.PacketPool.Put(b)
 	}
 }
 
 func (c *AictConn) writeRoutine() (err error) {
-	// wait init
-	select {
-	case <-c.ctx.Done():
-		return nil
-	case <-c.initialized:
+	c.log.Debug("enter write loop")
+	// the payload with credit in front, data echoes fit in EchoSize
+	pbuf := make([]byte, c.l.cfg.EchoSize)
+	// echoes are encoded into ebufs and sent in batches
+	ebufs := make([][]byte, proto.BatchSize)
+	for i := range ebufs {
+		ebufs[i] = make([]byte, proto.EchoHeaderLen+c.l.cfg.EchoSize)
 	}
-	log.Println("enter write loop")
+	ms := make([]proto.Message, proto.BatchSize)
 	// write loop
 	for {
+		var p packet
 		select {
 		case <-c.ctx.Done():
 			return nil
-		case w := <-c.writeBuffer:
-			msg := proto.Layer{
-				Flags:   0,
-				Payload: w,
+		case p = <-c.writeBuffer:
+		}
+		pair, ok := c.sequenceQueue.TryPop()
+		if !ok {
+			c.metrics.EmptyPops.Add(1)
+			// park until the client sends a keepalive, or the session is closed
+			if pair, err = c.sequenceQueue.PopContext(c.ctx); err != nil {
+				return nil
 			}
-			data, err := msg.Marshal()
+		}
+		n := 0
+		for {
+			raw, err := c.dataEcho(ebufs[n], pbuf, pair, &p)
 			if err != nil {
-				log.Printf("marshal msg: %v\n", err)
-			}
-			pair := c.sequenceQueue.Pop()
-			message := icmp.Message{
-				Type: ipv4.ICMPTypeEchoReply,
-				Code: 0,
-				Body: &icmp.Echo{
-					ID:   int(pair.Id),
-					Seq:  int(pair.Seq),
-					Data: data,
-				},
+				return err
 			}
-			raw, err := message.Marshal(nil)
-			if err != nil {
-				log.Printf("marshal icmp: %v", err)
+			ms[n] = proto.Message{Buf: raw, Addr: c.raddr}
+			n++
+			// more queued packets join the batch while there are pairs
+			if n == len(ms) || len(c.writeBuffer) == 0 {
+				break
 			}
-			_, err = c.conn.WriteTo(raw, c.raddr)
-			if err != nil {
-				return fmt.Errorf("icmp: write: %v", err)
+			if pair, ok = c.sequenceQueue.TryPop(); !ok {
+				break
 			}
+			// only the write routine receives, so a queued packet is there
+			p = <-c.writeBuffer
+		}
+		if err := c.l.conn.WriteBatch(ms[:n]); err != nil {
+			return fmt.Errorf("icmp: write: %v", err)
 		}
 	}
 }
 
+// dataEcho encodes p with credit in an echo reply of pair into b,
+// the payload is copied to pbuf to put credit in front. p.buf is recycled.
+func (c *AictConn) dataEcho(b, pbuf []byte, pair proto.IdSeqPair, p *packet) ([]byte, error) {
+	msg := &p.layer
+	// tell the client how many pairs are left and how many packets wait
+	credit := proto.Credit{
+		Depth:   uint16(min(c.sequenceQueue.Fresh(), math.MaxUint16)),
+		Waiting: uint16(min(len(c.writeBuffer), math.MaxUint16)),
+		Dropped: uint16(c.sequenceQueue.Dropped()),
+	}
+	msg.Flags |= proto.FlagCredit
+	credit.Put(pbuf)
+	msg.Payload = pbuf[:proto.CreditLen+copy(pbuf[proto.CreditLen:], msg.Payload)]
+	proto.PacketPool.Put(p.buf)
+	return c.echoTo(b, pair.Id, pair.Seq, msg)
+}
+
+// writeEcho sends the layer in an echo reply of id and seq
+func (c *AictConn) writeEcho(id, seq uint16, l *proto.Layer) error {
+	b := echoPool.Get()
+	defer echoPool.Put(b)
+	return c.writeEchoTo(b.B, id, seq, l)
+}
+
+// writeEchoTo is writeEcho encoding in b
+func (c *AictConn) writeEchoTo(b []byte, id, seq uint16, l *proto.Layer) error {
+	raw, err := c.echoTo(b, id, seq, l)
+	if err != nil {
+		return err
+	}
+	if _, err := c.l.conn.WriteTo(raw, c.raddr); err != nil {
+		return fmt.Errorf("icmp: write: %v", err)
+	}
+	return nil
+}
+
+// echoTo encodes the layer in an echo reply of id and seq into b and returns it
+func (c *AictConn) echoTo(b []byte, id, seq uint16, l *proto.Layer) ([]byte, error) {
+	n, err := proto.EncodeTo(b[proto.EchoHeaderLen:], l, c.l.cipher, c.nonce, c.l.family.EchoReplyType, id)
+	if err != nil {
+		return nil, fmt.Errorf("marshal msg: %v", err)
+	}
+	raw := b[:proto.EchoHeaderLen+n]
+	c.l.family.PutEcho(raw, c.l.family.EchoReplyType, id, seq, c.psh)
+	c.metrics.Sent(n, l.Flags&proto.FlagKeepalive > 0)
+	if c.log.Enabled(c.ctx, slog.LevelDebug) {
+		c.log.Debug("echo reply", "seq", seq, "flags", l.Flags, "len", n)
+	}
+	return raw, nil
+}
+
+// WritePacket sends data up to 64KB, packets larger than
+// Config.EchoSize are fragmented
 func (c *AictConn) WritePacket(data []byte) error {
+	if b := c.compress(data); b != nil {
+		return c.writePacket(proto.FlagCompress, b.B, b)
+	}
+	return c.writePacket(0, data, nil)
+}
+
+// WritePacketFrom is WritePacket with a copy of data, so the caller may reuse
+// data right away. Packets fitting in one echo are copied without allocation.
+func (c *AictConn) WritePacketFrom(data []byte) error {
+	if b := c.compress(data); b != nil {
+		return c.writePacket(proto.FlagCompress, b.B, b)
+	}
+	if len(data) > c.PathMTU() || len(data) > proto.PacketPool.Size() {
+		return c.writePacket(0, append([]byte(nil), data...), nil)
+	}
+	b := proto.CopyPacket(data)
+	return c.writePacket(0, b.B, b)
+}
+
+// writePacket queues data with flags, fragmented if it doesn't fit in one echo.
+// b holding data is recycled once sent, unless fragments of it are queued.
+func (c *AictConn) writePacket(flags uint8, data []byte, b *ds.Buffer) error {
+	if len(data) <= c.PathMTU() {
+		err := c.queue(packet{layer: proto.Layer{Flags: flags, Payload: data}, buf: b})
+		if err != nil {
+			proto.PacketPool.Put(b)
+		}
+		return err
+	}
+	layers, err := proto.Split(uint16(c.fragmentID.Add(1)), data, c.PathMTU())
+	if err != nil {
+		return err
+	}
+	for _, l := range layers {
+		l.Flags |= flags
+		if err := c.queue(packet{layer: l}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compress deflates data into a new buffer if compression is negotiated,
+// nil if it is not or data doesn't shrink
+func (c *AictConn) compress(data []byte) *ds.Buffer {
+	if c.caps&proto.CapCompression == 0 {
+		return nil
+	}
+	return proto.CompressPacket(data)
+}
+
+func (c *AictConn) queue(p packet) error {
 	select {
 	case <-c.ctx.Done():
-		return errors.New("connection closed")
-	case c.writeBuffer <- data:
+		return ErrConnClosed
+	case <-c.writeDeadline.Done():
+		return os.ErrDeadlineExceeded
+	case c.writeBuffer <- p:
 		return nil
 	}
 }
 
+// WritePackets is WritePacketFrom for each packet, so the caller may reuse them.
+// Packets queued together are sent in batches.
+func (c *AictConn) WritePackets(packets [][]byte) error {
+	for _, data := range packets {
+		if err := c.WritePacketFrom(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *AictConn) ReadPacket() ([]byte, error) {
+	b, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	// the caller owns it, not recycled
+	return b.B, nil
+}
+
+// ReadPacketTo is ReadPacket into buf without allocation, it returns
+// io.ErrShortBuffer and drops the packet if buf is too small.
+func (c *AictConn) ReadPacketTo(buf []byte) (int, error) {
+	b, err := c.readPacket()
+	if err != nil {
+		return 0, err
+	}
+	defer proto.PacketPool.Put(b)
+	if len(buf) < len(b.B) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(buf, b.B), nil
+}
+
+func (c *AictConn) readPacket() (*ds.Buffer, error) {
 	select {
 	case <-c.ctx.Done():
-		return nil, errors.New("connection closed")
-	case data := <-c.readBuffer:
-		return data, nil
+		return nil, ErrConnClosed
+	case <-c.readDeadline.Done():
+		return nil, os.ErrDeadlineExceeded
+	case b := <-c.readBuffer:
+		return b, nil
 	}
 }
@@ -2,16 +2,48 @@ package server
 
 import (
 	"fmt"
+	"github.com/BaiMeow/aict/proto"
 	"golang.org/x/net/icmp"
+	"log/slog"
 	"net"
+	"time"
 )
 
 type Config struct {
 	SeqQueueSize int
+	// SeqTTL discards id/seq pairs older than it, since firewalls forget
+	// echo requests after a timeout. 0 means the default, negative never expires.
+	SeqTTL time.Duration
+	// PSK enables encryption with the pre-shared key if not empty
+	PSK []byte
+	// EchoSize is the max size of icmp echo data, larger packets are fragmented
+	EchoSize int
+	// Compression deflates packets that shrink, if the client supports it
+	Compression bool
+	// IdleTimeout ends sessions without echoes from client in it,
+	// 0 means the default, negative never ends.
+	IdleTimeout time.Duration
+	// MaxSessions limits the clients served at once, 0 means 256
+	MaxSessions int
+	// Logger receives the logs of the listener and its sessions, nil uses slog.Default
+	Logger *slog.Logger
 }
 
-func Listen(laddr *net.IPAddr, raddr *net.IPAddr, cfg *Config) (*AictConn, error) {
-	conn, err := icmp.ListenPacket("ip4:icmp", laddr.String())
+// Listen opens the icmp socket, ICMPv6 is used if laddr is an ipv6 address.
+// raddr limits the clients to the given ip unless it is unspecified.
+// Sessions are returned by Listener.Accept.
+func Listen(laddr *net.IPAddr, raddr *net.IPAddr, cfg *Config) (*Listener, error) {
+	var cipher *proto.Cipher
+	if len(cfg.PSK) > 0 {
+		var err error
+		cipher, err = proto.NewCipher(cfg.PSK, proto.ServerToClient)
+		if err != nil {
+			return nil, fmt.Errorf("aict: cipher: %v", err)
+		}
+	}
+
+	family := proto.FamilyOf(laddr.IP)
+	conn, err := icmp.ListenPacket(family.Network, laddr.String())
 	if err != nil {
 		return nil, fmt.Errorf("icmp: listen: %v", err)
 	}
@@ -19,6 +51,21 @@ func Listen(laddr *net.IPAddr, raddr *net.IPAddr, cfg *Config) (*AictConn, error
 	if cfg.SeqQueueSize == 0 {
 		cfg.SeqQueueSize = 16
 	}
+	if cfg.SeqTTL == 0 {
+		cfg.SeqTTL = 25 * time.Second
+	}
+	if cfg.EchoSize == 0 {
+		cfg.EchoSize = 1400
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = time.Minute
+	}
+	if cfg.MaxSessions == 0 {
+		cfg.MaxSessions = 256
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
 
-	return newAict(conn, raddr, cfg), nil
+	return newListener(conn, laddr, raddr, family, cipher, cfg), nil
 }
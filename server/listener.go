@@ -0,0 +1,333 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/BaiMeow/aict/metrics"
+	"github.com/BaiMeow/aict/proto"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	acceptQueueLen = 16
+	// replaySenders is the nonce salts remembered against replays,
+	// a salt is a client run
+	replaySenders = 1024
+)
+
+var ErrClosed = errors.New("listener closed")
+
+// sessionKey identifies a client by source ip and echo id
+type sessionKey struct {
+	addr netip.Addr
+	id   uint16
+}
+
+// Listener owns the icmp socket and demultiplexes echo requests
+// into sessions, one per (source ip, echo id) pair.
+type Listener struct {
+	conn   *proto.BatchConn
+	laddr  *net.IPAddr
+	raddr  *net.IPAddr
+	family *proto.Family
+	cfg    *Config
+	// cipher is nil if encryption is disabled
+	cipher *proto.Cipher
+	// overhead is the bytes of echo data besides packet data,
+	// credit included since data echoes carry it
+	overhead int
+	// zbuf holds packets decompressed by the read loop
+	zbuf []byte
+	// replay is used by the read loop, nil if encryption is disabled
+	replay *proto.ReplayFilter
+
+	cancel context.CancelFunc
+	ctx    context.Context
+	log    *slog.Logger
+
+	lock     sync.Mutex
+	sessions map[sessionKey]*AictConn
+	accept   chan *AictConn
+
+	// metrics counts echoes not belonging to a session yet
+	metrics metrics.Metrics
+}
+
+func newListener(conn net.PacketConn, laddr, raddr *net.IPAddr, family *proto.Family, cipher *proto.Cipher, cfg *Config) *Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	overhead := proto.HeaderLen + proto.CreditLen
+	if cipher != nil {
+		overhead += cipher.Overhead()
+	}
+	var replay *proto.ReplayFilter
+	if cipher != nil {
+		replay = proto.NewReplayFilter(replaySenders)
+	}
+	l := &Listener{
+		conn:     proto.NewBatchConn(conn),
+		laddr:    laddr,
+		raddr:    raddr,
+		family:   family,
+		cfg:      cfg,
+		cipher:   cipher,
+		overhead: overhead,
+		zbuf:     make([]byte, bufferSize),
+		replay:   replay,
+		cancel:   cancel,
+		ctx:      ctx,
+		log:      cfg.Logger,
+		sessions: make(map[sessionKey]*AictConn),
+		accept:   make(chan *AictConn, acceptQueueLen),
+	}
+	if cfg.IdleTimeout > 0 {
+		go l.reaper(cfg.IdleTimeout)
+	}
+	go func() {
+		err := l.readRoutine()
+		if err == nil {
+			// closed by Close
+			return
+		}
+		l.log.Error("exit read loop", "err", err)
+		if err := l.Close(); err != nil {
+			l.log.Warn("close", "err", err)
+		}
+	}()
+	return l
+}
+
+// Accept waits for a new client and returns its session
+func (l *Listener) Accept() (*AictConn, error) {
+	select {
+	case <-l.ctx.Done():
+		return nil, ErrClosed
+	case c := <-l.accept:
+		return c, nil
+	}
+}
+
+// Close closes the socket and all sessions
+func (l *Listener) Close() error {
+	l.cancel()
+	return l.conn.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Logger is Config.Logger, slog.Default if it is nil
+func (l *Listener) Logger() *slog.Logger {
+	return l.log
+}
+
+// Sessions returns the live sessions
+func (l *Listener) Sessions() []*AictConn {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	sessions := make([]*AictConn, 0, len(l.sessions))
+	for _, c := range l.sessions {
+		sessions = append(sessions, c)
+	}
+	return sessions
+}
+
+// Metrics returns the counters of echoes before a session is found,
+// like parse errors, which sessions don't count
+func (l *Listener) Metrics() metrics.Snapshot {
+	return l.metrics.Snapshot()
+}
+
+func (l *Listener) remove(c *AictConn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.sessions[c.key] == c {
+		delete(l.sessions, c.key)
+	}
+}
+
+// session returns the session of key, a new one of the handshake is created
+// and queued for Accept if not exists. nil means the client is dropped.
+func (l *Listener) session(key sessionKey, ipaddr *net.IPAddr, h *proto.Handshake) *AictConn {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if c, ok := l.sessions[key]; ok {
+		return c
+	}
+	if !l.raddr.IP.IsUnspecified() && !l.raddr.IP.Equal(ipaddr.IP) {
+		return nil
+	}
+	if len(l.sessions) >= l.cfg.MaxSessions {
+		l.log.Warn("too many sessions, drop client", "peer", ipaddr.String(), "id", key.id, "max", l.cfg.MaxSessions)
+		return nil
+	}
+	c := newAict(l, key, ipaddr, h)
+	select {
+	case l.accept <- c:
+	default:
+		// accept queue is full
+		c.cancel()
+		return nil
+	}
+	l.sessions[key] = c
+	c.log.Info("accept session", "version", h.Version)
+	return c
+}
+
+func (l *Listener) lookup(key sessionKey) *AictConn {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.sessions[key]
+}
+
+// handshake returns the session of key, a new one is started if the handshake
+// is from a new session, like a client restarted with the same echo id.
+// nil means the handshake is invalid or the client is dropped.
+func (l *Listener) handshake(key sessionKey, ipaddr *net.IPAddr, msg *proto.Layer) *AictConn {
+	var h proto.Handshake
+	if err := h.Unmarshal(msg.Payload); err != nil {
+		return nil
+	}
+	reply, err := h.Negotiate(l.capabilities())
+	if err != nil {
+		l.log.Warn("handshake", "peer", ipaddr.String(), "id", key.id, "version", h.Version, "err", err)
+		return nil
+	}
+	if c := l.lookup(key); c != nil {
+		if c.session == h.Session {
+			return c
+		}
+		c.log.Info("client restarts", "newSession", fmt.Sprintf("%08x", h.Session))
+		c.shutdown()
+	}
+	return l.session(key, ipaddr, &reply)
+}
+
+// capabilities of the server
+func (l *Listener) capabilities() uint8 {
+	caps := uint8(proto.CapFragmentation)
+	if l.cipher != nil {
+		caps |= proto.CapEncryption
+	}
+	if l.cfg.Compression {
+		caps |= proto.CapCompression
+	}
+	return caps
+}
+
+// reaper ends sessions without echoes in timeout
+func (l *Listener) reaper(timeout time.Duration) {
+	t := time.NewTicker(timeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-t.C:
+		}
+		var idle []*AictConn
+		l.lock.Lock()
+		for _, c := range l.sessions {
+			if time.Since(time.Unix(0, c.lastSeen.Load())) > timeout {
+				idle = append(idle, c)
+			}
+		}
+		l.lock.Unlock()
+		for _, c := range idle {
+			c.log.Info("idle timeout")
+			if err := c.Close(); err != nil {
+				c.log.Warn("close", "err", err)
+			}
+		}
+	}
+}
+
+func (l *Listener) readRoutine() error {
+	// packets are decoded in place and copied out by sessions, so bufs are reused
+	bufs := make([][]byte, proto.BatchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, bufferSize)
+	}
+	ms := make([]proto.Message, proto.BatchSize)
+	var msg proto.Layer
+	for {
+		// check context
+		select {
+		case <-l.ctx.Done():
+			return nil
+		default:
+		}
+
+		err := l.conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+		if err != nil {
+			if l.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("icmp: set read deadline: %v", err)
+		}
+		for i := range ms {
+			ms[i].Buf = bufs[i]
+		}
+		n, err := l.conn.ReadBatch(ms)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			if l.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("icmp: read from: %v", err)
+		}
+
+		for i := 0; i < n; i++ {
+			echo, err := proto.ParseEcho(ms[i].Buf)
+			if err != nil {
+				l.metrics.ParseErrors.Add(1)
+				continue
+			}
+			if echo.Type != l.family.EchoRequestType {
+				continue
+			}
+
+			nonce, err := proto.Decode(&msg, &echo, l.cipher)
+			if err != nil {
+				l.metrics.ParseErrors.Add(1)
+				l.log.Debug("decode echo request", "peer", ms[i].Addr.String(), "id", echo.ID, "seq", echo.Seq, "err", err)
+				continue
+			}
+			// before any session is looked up, so a replayed handshake
+			// can't start a session again
+			if l.replay != nil && !l.replay.Check(nonce) {
+				l.log.Debug("replayed echo request", "peer", ms[i].Addr.String(), "id", echo.ID, "seq", echo.Seq)
+				continue
+			}
+
+			ipaddr, ok := ms[i].Addr.(*net.IPAddr)
+			if !ok {
+				return errors.New("PacketConn not return IPAddr")
+			}
+			ip, ok := netip.AddrFromSlice(ipaddr.IP)
+			if !ok {
+				continue
+			}
+			key := sessionKey{addr: ip.Unmap(), id: echo.ID}
+			var c *AictConn
+			if msg.Flags&proto.FlagHandshake > 0 {
+				c = l.handshake(key, ipaddr, &msg)
+			} else {
+				// only a handshake starts a session, so random pings are ignored
+				c = l.lookup(key)
+			}
+			if c == nil {
+				continue
+			}
+			c.handle(&echo, &msg)
+		}
+	}
+}
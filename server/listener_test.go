@@ -0,0 +1,234 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BaiMeow/aict/client"
+	"github.com/BaiMeow/aict/proto"
+	"golang.org/x/net/icmp"
+	"net"
+	"testing"
+	"time"
+)
+
+var loopback = &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// listen listens on loopback, the test is skipped without raw socket permission
+func listen(t *testing.T, cfg *Config) *Listener {
+	l, err := Listen(loopback, &net.IPAddr{IP: net.IPv4zero}, cfg)
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	return l
+}
+
+func dial(t *testing.T, cfg *client.Config) *client.AictConn {
+	c, err := client.Dial(&net.IPAddr{IP: net.IPv4zero}, loopback, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// acceptAll accepts sessions of l into the returned channel until l is closed
+func acceptAll(l *Listener) <-chan *AictConn {
+	ch := make(chan *AictConn, acceptQueueLen)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			ch <- c
+		}
+	}()
+	return ch
+}
+
+// next waits for a session until timeout, nil if none comes
+func next(accepted <-chan *AictConn, timeout time.Duration) *AictConn {
+	select {
+	case c := <-accepted:
+		return c
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+type packetReader interface {
+	ReadPacket() ([]byte, error)
+	SetReadDeadline(t time.Time) error
+}
+
+func readString(t *testing.T, c packetReader) string {
+	t.Helper()
+	if err := c.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSessions(t *testing.T) {
+	l := listen(t, &Config{IdleTimeout: -1, MaxSessions: 2})
+	accepted := acceptAll(l)
+	clients := make(map[uint16]*client.AictConn)
+	for _, id := range []uint16{1001, 1002} {
+		c := dial(t, &client.Config{Identify: int(id), PingInterval: -1})
+		if err := c.WritePacket([]byte(fmt.Sprint("from ", id))); err != nil {
+			t.Fatal(err)
+		}
+		clients[id] = c
+	}
+
+	sessions := make(map[uint16]*AictConn)
+	for range clients {
+		s := next(accepted, 5*time.Second)
+		if s == nil {
+			t.Fatal("no session accepted")
+		}
+		if _, ok := clients[s.ID()]; !ok || sessions[s.ID()] != nil {
+			t.Fatalf("unexpected session of id %d", s.ID())
+		}
+		sessions[s.ID()] = s
+	}
+
+	// each session only sees its own client
+	for id, s := range sessions {
+		if got, want := readString(t, s), fmt.Sprint("from ", id); got != want {
+			t.Fatalf("session %d read %q", id, got)
+		}
+		if err := s.WritePacket([]byte(fmt.Sprint("to ", id))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, c := range clients {
+		if got, want := readString(t, c), fmt.Sprint("to ", id); got != want {
+			t.Fatalf("client %d read %q", id, got)
+		}
+	}
+
+	// beyond MaxSessions
+	extra := dial(t, &client.Config{Identify: 1003, PingInterval: -1})
+	if err := extra.WritePacket([]byte("from 1003")); err != nil {
+		t.Fatal(err)
+	}
+	if s := next(accepted, time.Second); s != nil {
+		t.Fatalf("session of id %d accepted beyond MaxSessions", s.ID())
+	}
+	if n := len(l.Sessions()); n != 2 {
+		t.Fatalf("%d sessions", n)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	l := listen(t, &Config{IdleTimeout: 300 * time.Millisecond})
+	accepted := acceptAll(l)
+	c := dial(t, &client.Config{PingInterval: -1})
+	if err := c.WritePacket([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if next(accepted, 5*time.Second) == nil {
+		t.Fatal("no session accepted")
+	}
+
+	// the client is told by FlagClose once the session expires
+	if err := c.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadPacket(); !errors.Is(err, client.ErrPeerClosed) {
+		t.Fatalf("expect closed by peer, got %v", err)
+	}
+	if n := len(l.Sessions()); n != 0 {
+		t.Fatalf("%d sessions after idle timeout", n)
+	}
+}
+
+func TestReplayedHandshake(t *testing.T) {
+	psk := []byte("secret")
+	l := listen(t, &Config{PSK: psk, IdleTimeout: -1})
+	accepted := acceptAll(l)
+	conn, err := icmp.ListenPacket("ip4:icmp", loopback.String())
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	defer conn.Close()
+
+	cipher, err := proto.NewCipher(psk, proto.ClientToServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonces := proto.NewNonceSource()
+	family := proto.FamilyOf(loopback.IP)
+	// handshake seals a handshake echo request with a fresh nonce
+	handshake := func() []byte {
+		h := proto.Handshake{Version: proto.Version, Session: 0x1234}
+		layer := proto.Layer{Flags: proto.FlagHandshake, Payload: h.Marshal()}
+		b := make([]byte, 256)
+		n, err := proto.EncodeTo(b[proto.EchoHeaderLen:], &layer, cipher, nonces, family.EchoRequestType, 2001)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := b[:proto.EchoHeaderLen+n]
+		family.PutEcho(raw, family.EchoRequestType, 2001, 1, family.PseudoHeader(loopback.IP, loopback.IP))
+		return raw
+	}
+	send := func(raw []byte) {
+		if _, err := conn.WriteTo(raw, loopback); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorded := handshake()
+	send(recorded)
+	s := next(accepted, 5*time.Second)
+	if s == nil {
+		t.Fatal("no session accepted")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	send(recorded)
+	if s := next(accepted, time.Second); s != nil {
+		t.Fatal("replayed handshake starts a session")
+	}
+	send(handshake())
+	if next(accepted, 5*time.Second) == nil {
+		t.Fatal("fresh handshake after a replay is not accepted")
+	}
+}
+
+func TestRedial(t *testing.T) {
+	l := listen(t, &Config{IdleTimeout: -1})
+	accepted := acceptAll(l)
+	c := dial(t, &client.Config{Identify: 3001, PingInterval: 100 * time.Millisecond, DeadTimeout: 500 * time.Millisecond, Reconnect: true})
+	old := next(accepted, 5*time.Second)
+	if old == nil {
+		t.Fatal("no session accepted")
+	}
+	// lost without telling the client, which gets no ping replies then
+	old.shutdown()
+
+	s := next(accepted, 5*time.Second)
+	if s == nil {
+		t.Fatal("client doesn't redial")
+	}
+	if s.ID() == old.ID() {
+		t.Fatalf("redialed with the same id %d", s.ID())
+	}
+	if sessions := l.Sessions(); len(sessions) != 1 || sessions[0] != s {
+		t.Fatalf("sessions %v after redial", sessions)
+	}
+	if err := c.WritePacket([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, s); got != "again" {
+		t.Fatalf("read %q", got)
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"github.com/BaiMeow/aict/proto"
+)
+
+// minEchoSize is the smallest echo size a client may announce
+const minEchoSize = 256
+
+// pong replies the ping right away using its own id and seq,
+// the probe may announce the echo size found by client.
+func (c *AictConn) pong(echo *proto.Echo, msg *proto.Layer) {
+	var p proto.Probe
+	if err := p.Unmarshal(msg.Payload); err != nil {
+		return
+	}
+	// an echo can't be smaller than the overhead, it is not a real announcement
+	if announced := int(p.EchoSize); announced > c.l.overhead {
+		size := min(max(announced, minEchoSize), c.l.cfg.EchoSize)
+		c.maxPayload.Store(int32(size - c.l.overhead))
+		select {
+		case <-c.pmtuDone:
+		default:
+			close(c.pmtuDone)
+			c.log.Info("path mtu announced", "echoSize", size)
+		}
+	}
+
+	reply := proto.Layer{Flags: proto.FlagPing, Payload: msg.Payload}
+	if err := c.writeEcho(echo.ID, echo.Seq, &reply); err != nil {
+		c.log.Warn("pong", "seq", echo.Seq, "err", err)
+	}
+}
+
+// PathMTU is the largest packet sent in a single echo, larger ones are fragmented
+func (c *AictConn) PathMTU() int {
+	return int(c.maxPayload.Load())
+}
+
+// WaitPathMTU waits for the client to announce its path mtu and returns PathMTU
+func (c *AictConn) WaitPathMTU(ctx context.Context) int {
+	select {
+	case <-ctx.Done():
+	case <-c.pmtuDone:
+	}
+	return c.PathMTU()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BaiMeow/aict/mux"
+	"github.com/BaiMeow/aict/stream"
+	"gvisor.dev/gvisor/pkg/binary"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+)
+
+const (
+	socksVersion       = 5
+	socksMethodNoAuth  = 0
+	socksNoAcceptable  = 0xff
+	socksCmdConnect    = 1
+	socksAtypIPv4      = 1
+	socksAtypDomain    = 3
+	socksAtypIPv6      = 4
+	socksRepSucceeded  = 0
+	socksRepFailure    = 1
+	socksRepCmdUnsupp  = 7
+	socksRepAtypUnsupp = 8
+)
+
+// socksUp runs a local socks5 server, connections are proxied by the peer.
+// arg is the listen address, a single port listens on localhost.
+func socksUp(conn Conn, logger *slog.Logger, arg string, client bool) error {
+	if arg == "" {
+		arg = "1080"
+	}
+	if _, err := strconv.Atoi(arg); err == nil {
+		arg = net.JoinHostPort("127.0.0.1", arg)
+	}
+	ln, err := net.Listen("tcp", arg)
+	if err != nil {
+		return fmt.Errorf("listen socks5: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	logger.Info("socks5 listen", "addr", ln.Addr().String())
+
+	session := mux.New(conn, client, &stream.Config{Logger: logger})
+	defer func() { _ = session.Close() }()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("accept socks5: %v", err)
+		}
+		go handleSocks(session, logger, c)
+	}
+}
+
+func handleSocks(session *mux.Session, logger *slog.Logger, c net.Conn) {
+	target, err := socksHandshake(c)
+	if err != nil {
+		logger.Warn("socks5: handshake", "err", err)
+		_ = c.Close()
+		return
+	}
+	sc, err := dialProxy(session, target)
+	if err != nil {
+		logger.Warn("socks5: dial peer", "target", target, "err", err)
+		_ = socksReply(c, socksRepFailure)
+		_ = c.Close()
+		return
+	}
+	if err := socksReply(c, socksRepSucceeded); err != nil {
+		_ = c.Close()
+		_ = sc.Close()
+		return
+	}
+	join(c, sc)
+}
+
+// socksHandshake negotiates no auth and reads a connect request, RFC 1928
+func socksHandshake(c net.Conn) (string, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != socksVersion {
+		return "", fmt.Errorf("unsupported version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksMethodNoAuth {
+			method = socksMethodNoAuth
+		}
+	}
+	if _, err := c.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoAcceptable {
+		return "", errors.New("no acceptable auth method")
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socksCmdConnect {
+		_ = socksReply(c, socksRepCmdUnsupp)
+		return "", fmt.Errorf("unsupported command %d", req[1])
+	}
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, 4)
+		if req[3] == socksAtypIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, l[0])
+		if _, err := io.ReadFull(c, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		_ = socksReply(c, socksRepAtypUnsupp)
+		return "", fmt.Errorf("unsupported address type %d", req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksReply answers with an empty bind address
+func socksReply(c net.Conn, rep byte) error {
+	_, err := c.Write([]byte{socksVersion, rep, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
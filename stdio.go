@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"github.com/BaiMeow/aict/stream"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// stdioUp runs a reliable stream over conn on stdin and stdout,
+// e.g. for ssh -o ProxyCommand="aict -c -r remote_ip -p stdio"
+func stdioUp(conn Conn, logger *slog.Logger) error {
+	s := stream.New(conn, &stream.Config{Logger: logger})
+	go func() {
+		if _, err := io.Copy(s, os.Stdin); err != nil {
+			logger.Warn("copy stdin", "err", err)
+		}
+		if err := s.CloseWrite(); err != nil {
+			logger.Warn("close stream", "err", err)
+		}
+	}()
+	defer func() { _ = s.Close() }()
+	if _, err := io.Copy(os.Stdout, s); err != nil {
+		return fmt.Errorf("copy stdout: %v", err)
+	}
+	return nil
+}
+
+// tcpUp runs a reliable stream over conn and pipes it to a tcp conn dialed to addr
+func tcpUp(conn Conn, logger *slog.Logger, addr string) {
+	s := stream.New(conn, &stream.Config{Logger: logger})
+	tc, err := net.Dial("tcp", addr)
+	if err != nil {
+		logger.Warn("dial tcp", "addr", addr, "err", err)
+		_ = s.Close()
+		return
+	}
+	logger.Info("stream to tcp", "addr", addr)
+	join(s, tc)
+}
+
+// join copies data between a and b until both directions end
+func join(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(a, b)
+		closeWrite(a)
+		close(done)
+	}()
+	_, _ = io.Copy(b, a)
+	closeWrite(b)
+	<-done
+	_ = a.Close()
+	_ = b.Close()
+}
+
+// closeWrite half closes the conn if possible
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = c.Close()
+}
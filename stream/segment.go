@@ -0,0 +1,62 @@
+package stream
+
+import (
+	"errors"
+	"gvisor.dev/gvisor/pkg/binary"
+)
+
+const (
+	// segment carries data or fin and takes a sequence number
+	flagData = 1 << iota
+	// sender has nothing more to send, takes a sequence number
+	flagFin
+	// asks for an ack, sent while the window of the peer is closed
+	flagProbe
+)
+
+const headerLen = 11
+
+var errFormat = errors.New("invalid segment")
+
+// segment is the wire format of stream, seq numbers count segments not bytes.
+// Every segment carries a cumulative ack, the next seq expected by the sender,
+// and its window, the count of segments after ack the sender can still receive.
+type segment struct {
+	flags   uint8
+	seq     uint32
+	ack     uint32
+	wnd     uint16
+	payload []byte
+}
+
+func (s *segment) unmarshal(b []byte) error {
+	if len(b) < headerLen {
+		return errFormat
+	}
+	s.flags = b[0]
+	s.seq = binary.LittleEndian.Uint32(b[1:5])
+	s.ack = binary.LittleEndian.Uint32(b[5:9])
+	s.wnd = binary.LittleEndian.Uint16(b[9:11])
+	s.payload = b[headerLen:]
+	return nil
+}
+
+func (s *segment) marshal() []byte {
+	buf := make([]byte, headerLen+len(s.payload))
+	buf[0] = s.flags
+	binary.LittleEndian.PutUint32(buf[1:5], s.seq)
+	binary.LittleEndian.PutUint32(buf[5:9], s.ack)
+	binary.LittleEndian.PutUint16(buf[9:11], s.wnd)
+	copy(buf[headerLen:], s.payload)
+	return buf
+}
+
+// sequenced reports whether the segment takes a sequence number
+func (s *segment) sequenced() bool {
+	return s.flags&(flagData|flagFin) > 0
+}
+
+// seqLess compares sequence numbers with wraparound
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
@@ -0,0 +1,636 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	tickPeriod    = 10 * time.Millisecond
+	initRTO       = time.Second
+	minRTO        = 50 * time.Millisecond
+	maxRTO        = 10 * time.Second
+	maxRetransmit = 16
+	// duplicate acks to trigger fast retransmit
+	dupAckThreshold = 3
+)
+
+var ErrBroken = errors.New("stream: too many retransmissions")
+
+// PacketConn is the unreliable datagram conn the stream runs on,
+// both client.AictConn and server.AictConn implement it.
+type PacketConn interface {
+	ReadPacket() ([]byte, error)
+	WritePacket([]byte) error
+}
+
+// KeepaliveCarrier is implemented by conns sending keepalives on their own,
+// like client.AictConn. Pending acks are carried by the keepalives, the
+// payload func returns nil if there is nothing to carry.
+type KeepaliveCarrier interface {
+	SetKeepalivePayload(func() []byte)
+}
+
+type Config struct {
+	// MSS is the max payload size of a segment
+	MSS int
+	// Window is the max count of unacknowledged segments
+	Window int
+	// ReadBuffer is the max size of data received but not yet read,
+	// the peer stops sending when it is full
+	ReadBuffer int
+	// AckDelay is how long an ack may wait for data or keepalive to carry it
+	AckDelay time.Duration
+	// Linger is how long Close keeps retransmitting unacknowledged data
+	Linger time.Duration
+	// Logger receives the logs of the stream, nil uses slog.Default
+	Logger *slog.Logger
+}
+
+type outSegment struct {
+	seg         segment
+	sentAt      time.Time
+	retransmits int
+}
+
+// Conn is a reliable, in-order byte stream over a PacketConn, it implements net.Conn.
+// Segments are retransmitted until acknowledged, acks are cumulative.
+type Conn struct {
+	conn PacketConn
+	cfg  *Config
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	// send state, unacked[0] is the oldest unacknowledged segment
+	sndNext uint32
+	unacked []*outSegment
+	dupAcks int
+	// sndLimit is the first seq out of the window of the peer, Window
+	// until the peer advertises one, the window is probed while closed
+	sndLimit  uint32
+	probeAt   time.Time
+	probeWait time.Duration
+
+	// receive state, rcvLimit is the right edge of the advertised window
+	rcvNext         uint32
+	rcvLimit        uint32
+	outOfOrder      map[uint32]segment
+	readBuf         bytes.Buffer
+	ackPending      bool
+	ackPendingSince time.Time
+
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+
+	finRecv     bool
+	finSent     bool
+	closed      bool
+	lingerUntil time.Time
+	err         error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+
+	done       chan struct{}
+	finishOnce sync.Once
+}
+
+// New starts a stream over conn, the stream takes over all packets of conn
+// and closes it when the stream is finished if conn is an io.Closer.
+func New(conn PacketConn, cfg *Config) *Conn {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	if cfg.MSS == 0 {
+		cfg.MSS = 1200
+	}
+	if cfg.Window == 0 {
+		cfg.Window = 128
+	}
+	if cfg.ReadBuffer == 0 {
+		cfg.ReadBuffer = cfg.Window * cfg.MSS
+	}
+	cfg.ReadBuffer = max(cfg.ReadBuffer, cfg.MSS)
+	if cfg.AckDelay == 0 {
+		cfg.AckDelay = 20 * time.Millisecond
+	}
+	if cfg.Linger == 0 {
+		cfg.Linger = 10 * time.Second
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	c := &Conn{
+		conn:       conn,
+		cfg:        cfg,
+		outOfOrder: make(map[uint32]segment),
+		sndLimit:   uint32(cfg.Window),
+		rto:        initRTO,
+		done:       make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.lock)
+	// the initial window
+	c.window()
+	if k, ok := conn.(KeepaliveCarrier); ok {
+		k.SetKeepalivePayload(c.keepalivePayload)
+	}
+	go c.readRoutine()
+	go c.timerRoutine()
+	return c
+}
+
+func (c *Conn) readRoutine() {
+	for {
+		data, err := c.conn.ReadPacket()
+		if err != nil {
+			c.fail(fmt.Errorf("read packet: %v", err))
+			return
+		}
+		var seg segment
+		if err := seg.unmarshal(data); err != nil {
+			c.cfg.Logger.Warn("unmarshal segment", "err", err)
+			continue
+		}
+		c.input(&seg)
+	}
+}
+
+func (c *Conn) timerRoutine() {
+	ticker := time.NewTicker(tickPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		var out [][]byte
+		finished := false
+		c.lock.Lock()
+		now := time.Now()
+		backoff := false
+		for i, o := range c.unacked {
+			if now.Sub(o.sentAt) < c.rto {
+				continue
+			}
+			o.retransmits++
+			if o.retransmits > maxRetransmit {
+				c.setErr(ErrBroken)
+				finished = true
+				break
+			}
+			out = append(out, c.prepare(o, now))
+			// the oldest segment timed out, back off until a fresh rtt sample
+			backoff = backoff || i == 0
+		}
+		if backoff {
+			c.rto = min(c.rto*2, maxRTO)
+		}
+		if c.ackPending && now.Sub(c.ackPendingSince) >= c.cfg.AckDelay {
+			out = append(out, c.ack())
+		}
+		if raw := c.probe(now); raw != nil {
+			out = append(out, raw)
+		}
+		if c.closed && (len(c.unacked) == 0 || now.After(c.lingerUntil)) {
+			finished = true
+		}
+		c.lock.Unlock()
+
+		for _, raw := range out {
+			if err := c.conn.WritePacket(raw); err != nil {
+				c.fail(fmt.Errorf("write packet: %v", err))
+				return
+			}
+		}
+		if finished {
+			c.finish()
+			return
+		}
+	}
+}
+
+func (c *Conn) input(seg *segment) {
+	var out [][]byte
+	c.lock.Lock()
+	if c.handleAck(seg) {
+		// fast retransmit the oldest segment
+		o := c.unacked[0]
+		o.retransmits++
+		out = append(out, c.prepare(o, time.Now()))
+	}
+	if seg.sequenced() && !c.receive(seg) || seg.flags&flagProbe > 0 {
+		// ack at once so the sender learns about the hole or the window
+		out = append(out, c.ack())
+	}
+	c.cond.Broadcast()
+	c.lock.Unlock()
+
+	for _, raw := range out {
+		if err := c.conn.WritePacket(raw); err != nil {
+			c.fail(fmt.Errorf("write packet: %v", err))
+			return
+		}
+	}
+}
+
+// receive reports whether the segment is in order, the ack of it can be delayed
+func (c *Conn) receive(seg *segment) bool {
+	if !c.ackPending {
+		c.ackPending = true
+		c.ackPendingSince = time.Now()
+	}
+	switch {
+	case seg.seq == c.rcvNext && (seqLess(seg.seq, c.rcvLimit) || seg.flags&flagData == 0):
+		// a fin takes no room in the window
+		c.deliver(seg)
+		for {
+			next, ok := c.outOfOrder[c.rcvNext]
+			if !ok {
+				break
+			}
+			delete(c.outOfOrder, c.rcvNext)
+			c.deliver(&next)
+		}
+		return true
+	case seqLess(c.rcvNext, seg.seq) && seqLess(seg.seq, c.rcvLimit):
+		c.outOfOrder[seg.seq] = *seg
+		return false
+	default:
+		// duplicate, the ack of it may be lost, or out of the window
+		return false
+	}
+}
+
+// window advertises the room left in readBuf and moves rcvLimit, must hold lock.
+// The right edge never moves back, so the peer never sends out of the window.
+func (c *Conn) window() uint16 {
+	if limit := c.rcvNext + uint32(c.room(c.readBuf.Len())); seqLess(c.rcvLimit, limit) {
+		c.rcvLimit = limit
+	}
+	return uint16(c.rcvLimit - c.rcvNext)
+}
+
+// windowOpened reports whether reading made room worth an update to the peer,
+// half of the max window avoids updates of a few segments, must hold lock
+func (c *Conn) windowOpened() bool {
+	grow := int32(c.rcvNext + uint32(c.room(c.readBuf.Len())) - c.rcvLimit)
+	return int(grow) >= max(c.room(0)/2, 1)
+}
+
+// room is the count of segments fitting in readBuf holding buffered bytes
+func (c *Conn) room(buffered int) int {
+	return min(max(c.cfg.ReadBuffer-buffered, 0)/c.cfg.MSS, c.cfg.Window, math.MaxUint16)
+}
+
+func (c *Conn) deliver(seg *segment) {
+	if seg.flags&flagData > 0 {
+		c.readBuf.Write(seg.payload)
+	}
+	if seg.flags&flagFin > 0 {
+		c.finRecv = true
+	}
+	c.rcvNext++
+}
+
+// handleAck reports whether the oldest segment should be fast retransmitted
+func (c *Conn) handleAck(seg *segment) bool {
+	ack := seg.ack
+	if seqLess(c.sndNext, ack) {
+		// ack of data never sent
+		return false
+	}
+	opened := false
+	if limit := ack + uint32(seg.wnd); seqLess(c.sndLimit, limit) {
+		// reordered acks may advertise an older edge
+		c.sndLimit = limit
+		opened = true
+	}
+	if len(c.unacked) > 0 && c.unacked[0].seg.seq == ack {
+		if opened {
+			// a window update, not a duplicate
+			return false
+		}
+		c.dupAcks++
+		return c.dupAcks == dupAckThreshold
+	}
+	c.dupAcks = 0
+	// Karn's algorithm, skip samples if any acked segment was retransmitted,
+	// the others may have waited behind it at the receiver
+	sample := time.Duration(-1)
+	retransmitted := false
+	now := time.Now()
+	for len(c.unacked) > 0 && seqLess(c.unacked[0].seg.seq, ack) {
+		o := c.unacked[0]
+		retransmitted = retransmitted || o.retransmits > 0
+		sample = now.Sub(o.sentAt)
+		c.unacked[0] = nil
+		c.unacked = c.unacked[1:]
+	}
+	if sample >= 0 && !retransmitted {
+		c.updateRTO(sample)
+	}
+	return false
+}
+
+// updateRTO follows RFC 6298
+func (c *Conn) updateRTO(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		diff := c.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		c.rttvar = (3*c.rttvar + diff) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = min(max(c.srtt+max(tickPeriod, 4*c.rttvar), minRTO), maxRTO)
+}
+
+// prepare stamps the segment with the latest ack, must hold lock
+func (c *Conn) prepare(o *outSegment, now time.Time) []byte {
+	o.seg.ack = c.rcvNext
+	o.seg.wnd = c.window()
+	o.sentAt = now
+	c.ackPending = false
+	return o.seg.marshal()
+}
+
+// ack builds an ack only segment, must hold lock
+func (c *Conn) ack() []byte {
+	c.ackPending = false
+	seg := segment{ack: c.rcvNext, wnd: c.window()}
+	return seg.marshal()
+}
+
+// probe asks for the window of the peer while it is closed and nothing is
+// in flight to be acked, with backoff like retransmissions, must hold lock
+func (c *Conn) probe(now time.Time) []byte {
+	if len(c.unacked) > 0 || seqLess(c.sndNext, c.sndLimit) {
+		c.probeAt = time.Time{}
+		return nil
+	}
+	if c.probeAt.IsZero() {
+		c.probeWait = c.rto
+		c.probeAt = now.Add(c.probeWait)
+		return nil
+	}
+	if now.Before(c.probeAt) {
+		return nil
+	}
+	c.probeWait = min(c.probeWait*2, maxRTO)
+	c.probeAt = now.Add(c.probeWait)
+	seg := segment{flags: flagProbe, ack: c.rcvNext, wnd: c.window()}
+	c.ackPending = false
+	return seg.marshal()
+}
+
+func (c *Conn) keepalivePayload() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.ackPending {
+		return nil
+	}
+	return c.ack()
+}
+
+func (c *Conn) setErr(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.cond.Broadcast()
+}
+
+func (c *Conn) fail(err error) {
+	c.lock.Lock()
+	c.setErr(err)
+	c.lock.Unlock()
+	c.finish()
+}
+
+// finish flushes the pending ack and releases the underlying conn
+func (c *Conn) finish() {
+	c.finishOnce.Do(func() {
+		close(c.done)
+		c.lock.Lock()
+		var raw []byte
+		if c.ackPending && c.err == nil {
+			raw = c.ack()
+		}
+		c.setErr(net.ErrClosed)
+		c.lock.Unlock()
+		if raw != nil {
+			_ = c.conn.WritePacket(raw)
+		}
+		if closer, ok := c.conn.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				c.cfg.Logger.Warn("close stream conn", "err", err)
+			}
+		}
+	})
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.readBuf.Len() > 0:
+			n, err := c.readBuf.Read(b)
+			if c.windowOpened() {
+				// update the window at the next tick
+				c.ackPending = true
+				c.ackPendingSince = time.Time{}
+			}
+			return n, err
+		case c.finRecv:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case deadlineExceeded(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := 0
+	for len(b) > 0 {
+		for (len(c.unacked) >= c.cfg.Window || !seqLess(c.sndNext, c.sndLimit)) && !c.closed && !c.finSent && c.err == nil && !deadlineExceeded(c.writeDeadline) {
+			c.cond.Wait()
+		}
+		switch {
+		case c.closed || c.finSent:
+			return n, net.ErrClosed
+		case c.err != nil:
+			return n, c.err
+		case deadlineExceeded(c.writeDeadline):
+			return n, os.ErrDeadlineExceeded
+		}
+
+		size := min(len(b), c.cfg.MSS)
+		payload := make([]byte, size)
+		copy(payload, b[:size])
+		o := &outSegment{seg: segment{flags: flagData, seq: c.sndNext, payload: payload}}
+		c.sndNext++
+		c.unacked = append(c.unacked, o)
+		raw := c.prepare(o, time.Now())
+
+		c.lock.Unlock()
+		err := c.conn.WritePacket(raw)
+		c.lock.Lock()
+		if err != nil {
+			c.setErr(fmt.Errorf("write packet: %v", err))
+			return n, c.err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// CloseWrite sends fin, the peer reads io.EOF after all data. Reading goes on.
+func (c *Conn) CloseWrite() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return net.ErrClosed
+	}
+	raw := c.fin()
+	c.cond.Broadcast()
+	c.lock.Unlock()
+
+	if raw == nil {
+		return nil
+	}
+	if err := c.conn.WritePacket(raw); err != nil {
+		c.fail(fmt.Errorf("write packet: %v", err))
+		return err
+	}
+	return nil
+}
+
+// Close sends fin if not yet and returns at once, unacknowledged data is
+// retransmitted in background until acknowledged or Linger passes.
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.lingerUntil = time.Now().Add(c.cfg.Linger)
+	var raw []byte
+	if c.err == nil {
+		raw = c.fin()
+	}
+	broken := c.err != nil
+	c.cond.Broadcast()
+	c.lock.Unlock()
+
+	if broken {
+		c.finish()
+		return nil
+	}
+	if raw == nil {
+		return nil
+	}
+	if err := c.conn.WritePacket(raw); err != nil {
+		c.finish()
+	}
+	return nil
+}
+
+// fin queues the fin segment once, must hold lock
+func (c *Conn) fin() []byte {
+	if c.finSent {
+		return nil
+	}
+	c.finSent = true
+	o := &outSegment{seg: segment{flags: flagFin, seq: c.sndNext}}
+	c.sndNext++
+	c.unacked = append(c.unacked, o)
+	return c.prepare(o, time.Now())
+}
+
+type addr struct{}
+
+func (addr) Network() string { return "aict" }
+func (addr) String() string  { return "aict" }
+
+func (c *Conn) LocalAddr() net.Addr {
+	if a, ok := c.conn.(interface{ LocalAddr() net.Addr }); ok {
+		return a.LocalAddr()
+	}
+	return addr{}
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if a, ok := c.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return a.RemoteAddr()
+	}
+	return addr{}
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline = t
+	c.readTimer = c.resetDeadlineTimer(c.readTimer, t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeDeadline = t
+	c.writeTimer = c.resetDeadlineTimer(c.writeTimer, t)
+	return nil
+}
+
+// resetDeadlineTimer wakes up waiters when the deadline comes, must hold lock
+func (c *Conn) resetDeadlineTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	c.cond.Broadcast()
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		c.lock.Lock()
+		c.cond.Broadcast()
+		c.lock.Unlock()
+	})
+}
+
+func deadlineExceeded(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
@@ -0,0 +1,132 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn is one end of an in-memory packet pipe dropping some packets
+type lossyConn struct {
+	in   chan []byte
+	out  chan []byte
+	loss float64
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+func lossyPipe(loss float64) (*lossyConn, *lossyConn) {
+	a2b, b2a := make(chan []byte, 1024), make(chan []byte, 1024)
+	return &lossyConn{in: b2a, out: a2b, loss: loss, closed: make(chan struct{})},
+		&lossyConn{in: a2b, out: b2a, loss: loss, closed: make(chan struct{})}
+}
+
+func (c *lossyConn) ReadPacket() ([]byte, error) {
+	select {
+	case <-c.closed:
+		return nil, net.ErrClosed
+	case p := <-c.in:
+		return p, nil
+	}
+}
+
+func (c *lossyConn) WritePacket(p []byte) error {
+	if mrand.Float64() < c.loss {
+		return nil
+	}
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	case c.out <- append([]byte(nil), p...):
+	default:
+	}
+	return nil
+}
+
+func (c *lossyConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestStream(t *testing.T) {
+	a, b := lossyPipe(0.1)
+	cfg := &Config{MSS: 100, Window: 32}
+	ca, cb := New(a, cfg), New(b, cfg)
+
+	data := make([]byte, 50_000)
+	_, _ = rand.Read(data)
+	go func() {
+		if _, err := ca.Write(data); err != nil {
+			t.Error(err)
+		}
+		_ = ca.Close()
+	}()
+
+	got, err := io.ReadAll(cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("data mismatch, got %d bytes", len(got))
+	}
+	_ = cb.Close()
+}
+
+func TestStreamWindow(t *testing.T) {
+	a, b := lossyPipe(0.1)
+	cfg := &Config{MSS: 100, Window: 10, ReadBuffer: 1000}
+	ca, cb := New(a, cfg), New(b, cfg)
+
+	data := make([]byte, 20_000)
+	_, _ = rand.Read(data)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		if _, err := ca.Write(data); err != nil {
+			t.Error(err)
+		}
+		_ = ca.Close()
+	}()
+
+	// the writer is stopped by the window while nothing is read
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case <-written:
+		t.Fatal("write done without reading")
+	default:
+	}
+	cb.lock.Lock()
+	buffered := cb.readBuf.Len()
+	cb.lock.Unlock()
+	if buffered > cfg.ReadBuffer {
+		t.Fatalf("%d bytes buffered beyond ReadBuffer", buffered)
+	}
+
+	got, err := io.ReadAll(cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("data mismatch, got %d bytes", len(got))
+	}
+	_ = cb.Close()
+}
+
+func TestStreamDeadline(t *testing.T) {
+	a, _ := lossyPipe(0)
+	c := New(a, nil)
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := c.Read(make([]byte, 10))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+}
@@ -1,46 +1,97 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/BaiMeow/aict/netcfg"
 	"golang.zx2c4.com/wireguard/tun"
-	"log"
+	"log/slog"
 	"net"
-	"strings"
+	"time"
 )
 
-const MessageTransportOffsetContent = 16
+const (
+	MessageTransportOffsetContent = 16
+	defaultMTU                    = 1280
+	minMTU                        = 576
+	// maxAutoMTU is a jumbo frame, read buffers of an auto mtu tun fit it
+	maxAutoMTU  = 9000
+	pathMTUWait = time.Minute
+)
+
+type pathMTUConn interface {
+	WaitPathMTU(ctx context.Context) int
+}
+
+// autoMTU waits for path mtu discovery of conn and sets the mtu of tun iface,
+// so a packet fits in one echo. The tun keeps defaultMTU if nothing is found.
+func autoMTU(ctx context.Context, conn Conn, logger *slog.Logger, iface string) {
+	pc, ok := conn.(pathMTUConn)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, pathMTUWait)
+	defer cancel()
+	mtu := pc.WaitPathMTU(ctx)
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		logger.Warn("path mtu unknown, keep tun mtu", "mtu", defaultMTU, "wait", pathMTUWait)
+		return
+	case ctx.Err() != nil:
+		return
+	}
+	mtu = min(max(mtu, minMTU), maxAutoMTU)
+	if err := netcfg.SetMTU(iface, mtu); err != nil {
+		logger.Warn("set tun mtu", "mtu", mtu, "err", err)
+		return
+	}
+	logger.Info("tun mtu", "mtu", mtu)
+}
 
-func tunUp(conn Conn, arg string) {
+// tunUp pipes packets between a tun device and conn, it returns when either fails
+func tunUp(conn Conn, logger *slog.Logger, arg string, mtu int, address string, routes []string) error {
 	if arg == "" {
 		arg = "tun0"
 	}
-	device, err := tun.CreateTUN(arg, MTU)
+	// an auto mtu tun starts with defaultMTU, path mtu discovery may take a while
+	auto := mtu == 0
+	bufMTU := mtu
+	if auto {
+		mtu, bufMTU = defaultMTU, maxAutoMTU
+	}
+	device, err := tun.CreateTUN(arg, mtu)
+	if err != nil {
+		return fmt.Errorf("create tun: %v", err)
+	}
 	defer func() {
-		log.Println("exit tun, close it")
+		logger.Info("exit tun, close it")
 		err := device.Close()
 		if err != nil {
-			log.Println("close tun: ", err)
+			logger.Warn("close tun", "err", err)
 		}
 	}()
-	if err != nil {
-		log.Fatalf("create tun: %v", err)
-	}
 
 	_, cidr, err := net.ParseCIDR(address)
 	if err != nil {
-		log.Fatalf("parse address: %v", err)
+		return fmt.Errorf("parse address: %v", err)
 	}
 	var routesCIDR []*net.IPNet
-	for _, route := range strings.Split(routes, ",") {
+	for _, route := range routes {
 		_, cidr, err := net.ParseCIDR(route)
 		if err != nil {
-			log.Fatalf("parse route: %v", err)
+			return fmt.Errorf("parse route: %v", err)
 		}
 		routesCIDR = append(routesCIDR, cidr)
 	}
 
 	if err := netcfg.ApplyNet(arg, cidr, routesCIDR); err != nil {
-		log.Fatalf("apply net: %v", err)
+		return fmt.Errorf("apply net: %v", err)
+	}
+	if auto {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go autoMTU(ctx, conn, logger, arg)
 	}
 
 	go func() {
@@ -49,13 +100,13 @@ func tunUp(conn Conn, arg string) {
 			ev := <-evChan
 			switch ev {
 			case tun.EventUp:
-				log.Println("tun up")
+				logger.Info("tun up")
 			case tun.EventDown:
-				log.Println("tun down")
+				logger.Info("tun down")
 			case tun.EventMTUUpdate:
-				log.Println("tun mtu update")
+				logger.Info("tun mtu update")
 			case 0:
-				log.Println("tun event channel closed")
+				logger.Info("tun event channel closed")
 				return
 			default:
 				panic("unhandled default case")
@@ -66,33 +117,44 @@ func tunUp(conn Conn, arg string) {
 	batchSize := device.BatchSize()
 	rbufs := make([][]byte, batchSize)
 	rbufSizes := make([]int, batchSize)
+	packets := make([][]byte, batchSize)
 	for i := 0; i < batchSize; i++ {
-		rbufs[i] = make([]byte, 1700)
+		rbufs[i] = make([]byte, MessageTransportOffsetContent+bufMTU)
 	}
+	// both directions report here, the first error ends the pipe
+	errc := make(chan error, 2)
 	go func() {
 		for {
 			n, err := device.Read(rbufs, rbufSizes, MessageTransportOffsetContent)
 			if err != nil {
-				log.Fatalf("read tun: %v", err)
+				errc <- fmt.Errorf("read tun: %v", err)
+				return
 			}
 			for i := 0; i < n; i++ {
-				err := conn.WritePacket(rbufs[i][MessageTransportOffsetContent : MessageTransportOffsetContent+rbufSizes[i]])
-				if err != nil {
-					log.Fatalf("write packet: %v", err)
-				}
+				packets[i] = rbufs[i][MessageTransportOffsetContent : MessageTransportOffsetContent+rbufSizes[i]]
+			}
+			// rbufs are reused by the next read, so packets are copied
+			if err := conn.WritePackets(packets[:n]); err != nil {
+				errc <- fmt.Errorf("write packet: %v", err)
+				return
 			}
 		}
 	}()
 
-	wbuf := make([]byte, 1700)
-	for {
-		data, err := conn.ReadPacket()
-		if err != nil {
-			log.Fatalf("read packet: %v", err)
-		}
-		copy(wbuf[MessageTransportOffsetContent:], data)
-		if _, err := device.Write([][]byte{wbuf[:MessageTransportOffsetContent+len(data)]}, MessageTransportOffsetContent); err != nil {
-			log.Fatalf("write tun: %v", err)
+	go func() {
+		// packets up to 64KB are reassembled by conn
+		wbuf := make([]byte, MessageTransportOffsetContent+65535)
+		for {
+			n, err := conn.ReadPacketTo(wbuf[MessageTransportOffsetContent:])
+			if err != nil {
+				errc <- fmt.Errorf("read packet: %v", err)
+				return
+			}
+			if _, err := device.Write([][]byte{wbuf[:MessageTransportOffsetContent+n]}, MessageTransportOffsetContent); err != nil {
+				errc <- fmt.Errorf("write tun: %v", err)
+				return
+			}
 		}
-	}
+	}()
+	return <-errc
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const udpBufferSize = 65535
+
+// udpUp binds a local udp socket and pipes datagrams through conn.
+// arg format: <bind>[=<peer>], bind is a port or host:port,
+// peer is the initial udp peer which is replaced by the last seen one.
+func udpUp(conn Conn, logger *slog.Logger, arg string) error {
+	bind, peerArg, _ := strings.Cut(arg, "=")
+	laddr, err := parseUDPAddr(bind)
+	if err != nil {
+		return fmt.Errorf("parse udp bind: %v", err)
+	}
+
+	var peer atomic.Pointer[net.UDPAddr]
+	if peerArg != "" {
+		raddr, err := net.ResolveUDPAddr("udp", peerArg)
+		if err != nil {
+			return fmt.Errorf("parse udp peer: %v", err)
+		}
+		peer.Store(raddr)
+	}
+
+	uc, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return fmt.Errorf("listen udp: %v", err)
+	}
+	defer func() {
+		logger.Info("exit udp, close it")
+		if err := uc.Close(); err != nil {
+			logger.Warn("close udp", "err", err)
+		}
+	}()
+	logger.Info("udp listen", "addr", uc.LocalAddr().String())
+
+	// both directions report here, the first error ends the pipe
+	errc := make(chan error, 2)
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, addr, err := uc.ReadFromUDP(buf)
+			if err != nil {
+				errc <- fmt.Errorf("read udp: %v", err)
+				return
+			}
+			if old := peer.Load(); old == nil || !old.IP.Equal(addr.IP) || old.Port != addr.Port {
+				logger.Info("udp peer", "addr", addr.String())
+				peer.Store(addr)
+			}
+			// conn copies the packet, so buf is reused
+			if err := conn.WritePacketFrom(buf[:n]); err != nil {
+				errc <- fmt.Errorf("write packet: %v", err)
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			data, err := conn.ReadPacket()
+			if err != nil {
+				errc <- fmt.Errorf("read packet: %v", err)
+				return
+			}
+			raddr := peer.Load()
+			if raddr == nil {
+				// no peer yet, drop
+				continue
+			}
+			if _, err := uc.WriteToUDP(data, raddr); err != nil {
+				logger.Warn("write udp", "err", err)
+			}
+		}
+	}()
+	return <-errc
+}
+
+func parseUDPAddr(s string) (*net.UDPAddr, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty address")
+	}
+	if port, err := strconv.Atoi(s); err == nil {
+		return &net.UDPAddr{Port: port}, nil
+	}
+	return net.ResolveUDPAddr("udp", s)
+}